@@ -30,12 +30,21 @@ var (
 	env             string
 	pool            string
 	registryURL     string
+	replicaURLs     string
 	loop            bool
 	hostIP          string
 	dns             string
 	shuttleAddr     string
 	debug           bool
+	logLevel        string
+	labelVars       string
+	skipPortless    bool
+	redisStats      bool
+	actor           string
+	staleConfig     bool
 	runOnce         bool
+	pollInterval    time.Duration
+	reapInterval    time.Duration
 	version         bool
 	buildVersion    string
 	serviceRegistry *registry.ServiceRegistry
@@ -55,12 +64,35 @@ func initOrDie() {
 	serviceRegistry = registry.NewServiceRegistry(
 		registry.DefaultTTL,
 	)
+
+	for _, u := range strings.Split(replicaURLs, ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			serviceRegistry.ReplicaURLs = append(serviceRegistry.ReplicaURLs, u)
+		}
+	}
+	serviceRegistry.InstrumentRedis = redisStats
 	serviceRegistry.Connect(registryURL)
+	serviceRegistry.SkipPortless = skipPortless
+
+	for _, v := range strings.Split(labelVars, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			serviceRegistry.LabelVars = append(serviceRegistry.LabelVars, v)
+		}
+	}
 
 	configStore = config.NewStore(
 		registry.DefaultTTL,
 	)
 
+	envKeys, err := config.ParseEnvKeys(os.Getenv("GALAXY_ENV_KEYS"))
+	if err != nil {
+		log.Fatalf("ERROR: Bad GALAXY_ENV_KEYS: %s", err)
+	}
+	configStore.EnvKeys = envKeys
+	configStore.Actor = actor
+	configStore.StaleReads = staleConfig
+	serviceRegistry.Audit = configStore.AuditRegistry
+
 	configStore.Connect(registryURL)
 
 	serviceRuntime = runtime.NewServiceRuntime(serviceRegistry, dns, hostIP)
@@ -85,6 +117,12 @@ func initOrDie() {
 	go deregisterHost(signalsChan)
 }
 
+// defaultActor names the local user and host for audit entries.
+func defaultActor() string {
+	hostname, _ := os.Hostname()
+	return os.Getenv("USER") + "@" + hostname
+}
+
 func ensureEnv() {
 	envs, err := configStore.ListEnvs()
 	if err != nil {
@@ -409,29 +447,40 @@ func monitorService(changedConfigs chan *config.ConfigChange) {
 func main() {
 	flag.Int64Var(&stopCutoff, "cutoff", 10, "Seconds to wait before stopping old containers")
 	flag.StringVar(&registryURL, "registry", utils.GetEnv("GALAXY_REGISTRY_URL", "redis://127.0.0.1:6379"), "registry URL")
+	flag.StringVar(&replicaURLs, "registry-replicas", utils.GetEnv("GALAXY_REGISTRY_REPLICAS", ""), "Read replica registry URLs (redis://10.0.0.2:6379,...)")
 	flag.StringVar(&env, "env", utils.GetEnv("GALAXY_ENV", ""), "Environment namespace")
 	flag.StringVar(&pool, "pool", utils.GetEnv("GALAXY_POOL", ""), "Pool namespace")
 	flag.StringVar(&hostIP, "host-ip", "127.0.0.1", "Host IP")
 	flag.StringVar(&shuttleAddr, "shuttle-addr", "", "Shuttle API addr (127.0.0.1:9090)")
 	flag.StringVar(&dns, "dns", "", "DNS addr to use for containers")
+	flag.StringVar(&labelVars, "labels", utils.GetEnv("GALAXY_LABELS", ""), "Container env vars to publish as registration labels (APP_VERSION,GIT_SHA)")
+	flag.BoolVar(&skipPortless, "skip-portless", false, "Don't register containers that publish no ports")
+	flag.BoolVar(&redisStats, "redis-stats", utils.GetEnv("GALAXY_REDIS_STATS", "") != "", "Record registry redis command timings (agents publish them to the api command's /_stats)")
+	flag.StringVar(&actor, "actor", utils.GetEnv("GALAXY_ACTOR", defaultActor()), "Name recorded in the audit log for changes")
+	flag.BoolVar(&staleConfig, "stale-config", utils.GetEnv("GALAXY_STALE_CONFIG", "") != "", "Use the last config read while redis is unreachable")
 	flag.BoolVar(&debug, "debug", false, "verbose logging")
+	flag.StringVar(&logLevel, "log-level", utils.GetEnv("GALAXY_LOG_LEVEL", "info"), "Log level (debug, info, warn, error)")
 	flag.BoolVar(&version, "v", false, "display version info")
 
 	flag.Usage = func() {
 		println("Usage: commander [options] <command> [<args>]\n")
 		println("Available commands are:")
 		println("   agent           Runs commander agent")
+		println("   api             Serve a read-only HTTP API")
 		println("   app             List all apps")
 		println("   app:assign      Assign an app to a pool")
 		println("   app:create      Create an app")
 		println("   app:deploy      Deploy an app")
 		println("   app:delete      Delete an app")
+		println("   app:history     List prior configs of an app")
 		println("   app:restart     Restart an app")
+		println("   app:rollback    Restore a prior config of an app")
 		println("   app:run         Run a command within an app on this host")
 		println("   app:shell       Run a bash shell within an app on this host")
 		println("   app:start       Starts one or more apps")
 		println("   app:stop        Stops one or more apps")
 		println("   app:unassign    Unassign an app from a pool")
+		println("   audit           List recent changes in an environment")
 		println("   config          List config for an app")
 		println("   config:get      Get config values for an app")
 		println("   config:set      Set config values for an app")
@@ -439,6 +488,8 @@ func main() {
 		println("   runtime         List container runtime policies")
 		println("   runtime:set     Set container runtime policies")
 		println("   hosts           List hosts in an env and pool")
+		println("   pool:clear      Unassign and delete all apps in a pool")
+		println("   registry:migrate Migrate registry keys to the current schema")
 		println("\nOptions:\n")
 		flag.PrintDefaults()
 	}
@@ -450,8 +501,14 @@ func main() {
 		return
 	}
 
+	level, err := log.ParseLevel(logLevel)
+	if err != nil {
+		log.Fatalf("ERROR: %s", err)
+	}
+	log.SetLevel(level)
+
 	if debug {
-		log.DefaultLogger.Level = log.DEBUG
+		log.SetLevel(log.DEBUG)
 	}
 
 	if flag.NArg() < 1 {
@@ -474,7 +531,11 @@ func main() {
 			println("Options:\n\n")
 			agentFs.PrintDefaults()
 		}
+		agentFs.DurationVar(&pollInterval, "poll-interval", config.DefaultPollInterval, "How often to poll for config changes")
+		agentFs.DurationVar(&reapInterval, "reap-interval", registry.DefaultReapInterval, "How often to remove registrations of stopped containers")
 		agentFs.Parse(flag.Args()[1:])
+		configStore.PollInterval = pollInterval
+		serviceRegistry.ReapInterval = reapInterval
 
 		ensureEnv()
 		ensurePool()
@@ -492,6 +553,30 @@ func main() {
 		}
 		*/
 
+	case "api":
+		apiFs := flag.NewFlagSet("api", flag.ExitOnError)
+		apiFs.Usage = func() {
+			println("Usage: commander api [options]\n")
+			println("    Serve a read-only HTTP API of apps, pools and registrations\n")
+			println("Options:\n")
+			apiFs.PrintDefaults()
+		}
+		addr := apiFs.String("addr", "127.0.0.1:8100", "Address to listen on")
+		adminAddr := apiFs.String("admin-addr", "", "Address to serve the admin API on, which can change the log level.  Off if empty")
+		apiFs.Parse(flag.Args()[1:])
+
+		if *adminAddr != "" {
+			go func() {
+				log.Fatalf("ERROR: %s", commander.ServeAdminAPI(*adminAddr))
+			}()
+		}
+
+		err := commander.ServeAPI(*addr, configStore, serviceRegistry)
+		if err != nil {
+			log.Fatalf("ERROR: %s", err)
+		}
+		return
+
 	case "app":
 		appFs := flag.NewFlagSet("app", flag.ExitOnError)
 		appFs.Usage = func() {
@@ -599,6 +684,52 @@ func main() {
 		}
 		return
 
+	case "app:history":
+		appFs := flag.NewFlagSet("app:history", flag.ExitOnError)
+		appFs.Usage = func() {
+			println("Usage: commander app:history <app>\n")
+			println("    List prior configs of an app in an environment\n")
+			println("Options:\n")
+			appFs.PrintDefaults()
+		}
+		appFs.Parse(flag.Args()[1:])
+
+		ensureEnv()
+
+		if appFs.NArg() != 1 {
+			appFs.Usage()
+			os.Exit(1)
+		}
+
+		err := commander.AppHistory(configStore, appFs.Args()[0], env)
+		if err != nil {
+			log.Fatalf("ERROR: %s", err)
+		}
+		return
+
+	case "app:rollback":
+		appFs := flag.NewFlagSet("app:rollback", flag.ExitOnError)
+		appFs.Usage = func() {
+			println("Usage: commander app:rollback <app> <config>\n")
+			println("    Restore a config listed by app:history\n")
+			println("Options:\n")
+			appFs.PrintDefaults()
+		}
+		appFs.Parse(flag.Args()[1:])
+
+		ensureEnv()
+
+		if appFs.NArg() != 2 {
+			appFs.Usage()
+			os.Exit(1)
+		}
+
+		err := commander.AppRollback(configStore, appFs.Args()[0], env, appFs.Args()[1])
+		if err != nil {
+			log.Fatalf("ERROR: %s", err)
+		}
+		return
+
 	case "app:restart":
 		appFs := flag.NewFlagSet("app:restart", flag.ExitOnError)
 		appFs.Usage = func() {
@@ -763,6 +894,34 @@ func main() {
 		}
 		return
 
+	case "audit":
+		auditFs := flag.NewFlagSet("audit", flag.ExitOnError)
+		limit := auditFs.Int("n", 50, "Number of entries to list, 0 for all")
+		registrations := auditFs.Bool("registry", false, "List registration changes instead")
+		auditFs.Usage = func() {
+			println("Usage: commander audit [-n 50] [-registry]\n")
+			println("    List recent changes to apps and pools, or to registrations\n")
+			println("Options:\n")
+			auditFs.PrintDefaults()
+		}
+		err := auditFs.Parse(flag.Args()[1:])
+		if err != nil {
+			log.Fatalf("ERROR: Bad command line options: %s", err)
+		}
+
+		ensureEnv()
+
+		auditLog := ""
+		if *registrations {
+			auditLog = config.RegistryAuditLog
+		}
+
+		err = commander.AuditList(configStore, env, auditLog, *limit)
+		if err != nil {
+			log.Fatalf("ERROR: %s", err)
+		}
+		return
+
 	case "hosts":
 		hostFs := flag.NewFlagSet("hosts", flag.ExitOnError)
 		hostFs.Usage = func() {
@@ -784,6 +943,48 @@ func main() {
 			log.Fatalf("ERROR: %s", err)
 		}
 		return
+
+	case "pool:clear":
+		poolFs := flag.NewFlagSet("pool:clear", flag.ExitOnError)
+		poolFs.Usage = func() {
+			println("Usage: commander pool:clear\n")
+			println("    Unassign all apps from a pool, deleting those not assigned to another pool\n")
+			println("Options:\n")
+			poolFs.PrintDefaults()
+		}
+		err := poolFs.Parse(flag.Args()[1:])
+		if err != nil {
+			log.Fatalf("ERROR: Bad command line options: %s", err)
+		}
+
+		ensureEnv()
+		ensurePool()
+
+		err = commander.PoolClear(configStore, serviceRegistry, env, pool)
+		if err != nil {
+			log.Fatalf("ERROR: %s", err)
+		}
+		return
+	case "registry:migrate":
+		migrateFs := flag.NewFlagSet("registry:migrate", flag.ExitOnError)
+		dryRun := migrateFs.Bool("dry-run", false, "List the changes without making them")
+		migrateFs.Usage = func() {
+			println("Usage: commander registry:migrate [-dry-run]\n")
+			println("    Migrate registry keys written by older versions to the current schema\n")
+			println("Options:\n")
+			migrateFs.PrintDefaults()
+		}
+		err := migrateFs.Parse(flag.Args()[1:])
+		if err != nil {
+			log.Fatalf("ERROR: Bad command line options: %s", err)
+		}
+
+		err = commander.RegistryMigrate(serviceRegistry, *dryRun)
+		if err != nil {
+			log.Fatalf("ERROR: %s", err)
+		}
+		return
+
 	case "config":
 		configFs := flag.NewFlagSet("config", flag.ExitOnError)
 		usage := "Usage: commander config <app>"
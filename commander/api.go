@@ -0,0 +1,217 @@
+package commander
+
+import (
+	"encoding/json"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/litl/galaxy/config"
+	"github.com/litl/galaxy/log"
+	"github.com/litl/galaxy/registry"
+	"github.com/litl/galaxy/utils"
+)
+
+// appInfo is the API representation of an app's config.  The environment is
+// left out since it usually holds credentials.
+type appInfo struct {
+	Name      string            `json:"name"`
+	ID        int64             `json:"id"`
+	Version   string            `json:"version"`
+	VersionID string            `json:"versionID"`
+	Ports     map[string]string `json:"ports"`
+	Processes int               `json:"processes"`
+	Memory    string            `json:"memory,omitempty"`
+	CPUShares string            `json:"cpuShares,omitempty"`
+}
+
+// API serves a read-only JSON view of the config store and registry:
+//
+//	GET /envs
+//	GET /<env>/pools
+//	GET /<env>/<pool>/apps
+//	GET /<env>/<pool>/apps/<app>
+//	GET /<env>/<pool>/apps/<app>/instances
+//	GET /_stats
+//	GET /_loglevel
+//
+// Apps are only found in the pools they're assigned to.  /_stats returns the
+// API process's config cache counters, the redis command counters published
+// by agents running with -redis-stats, and those of the API process itself
+// when it records them.
+// /_loglevel returns the log level; it's changed through the admin API.
+type API struct {
+	configStore     *config.Store
+	serviceRegistry *registry.ServiceRegistry
+}
+
+func NewAPI(configStore *config.Store, serviceRegistry *registry.ServiceRegistry) *API {
+	return &API{
+		configStore:     configStore,
+		serviceRegistry: serviceRegistry,
+	}
+}
+
+// ServeAPI listens on addr and serves the API until it fails.
+func ServeAPI(addr string, configStore *config.Store, serviceRegistry *registry.ServiceRegistry) error {
+	log.Printf("Serving API on %s", addr)
+	return http.ListenAndServe(addr, NewAPI(configStore, serviceRegistry))
+}
+
+func (a *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	parts := strings.Split(strings.Trim(path.Clean(r.URL.Path), "/"), "/")
+
+	var (
+		v   interface{}
+		err error
+	)
+
+	switch {
+	case len(parts) == 1 && parts[0] == "envs":
+		v, err = a.configStore.ListEnvs()
+	case len(parts) == 1 && parts[0] == "_stats":
+		v, err = a.stats()
+	case len(parts) == 1 && parts[0] == "_loglevel":
+		v = logLevel()
+	case len(parts) == 2 && parts[1] == "pools":
+		v, err = a.configStore.ListPools(parts[0])
+	case len(parts) == 3 && parts[2] == "apps":
+		v, err = a.configStore.ListAssignments(parts[0], parts[1])
+	case len(parts) == 4 && parts[2] == "apps":
+		v, err = a.app(parts[0], parts[1], parts[3])
+	case len(parts) == 5 && parts[2] == "apps" && parts[4] == "instances":
+		v, err = a.instances(parts[0], parts[1], parts[3])
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	if err != nil {
+		log.Errorf("ERROR: %s %s: %s", r.Method, r.URL.Path, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if v == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func (a *API) stats() (interface{}, error) {
+	stats := map[string]interface{}{
+		"cache": a.configStore.CacheStats(),
+	}
+
+	if a.serviceRegistry == nil {
+		return stats, nil
+	}
+
+	hosts, err := a.serviceRegistry.ListHostStats()
+	if err != nil {
+		return nil, err
+	}
+
+	stats["api"] = a.serviceRegistry.BackendStats()
+	stats["hosts"] = hosts
+	return stats, nil
+}
+
+// assigned reports whether app is assigned to pool in env.
+func (a *API) assigned(env, pool, app string) (bool, error) {
+	apps, err := a.configStore.ListAssignments(env, pool)
+	if err != nil {
+		return false, err
+	}
+	return utils.StringInSlice(app, apps), nil
+}
+
+func (a *API) app(env, pool, app string) (interface{}, error) {
+	assigned, err := a.assigned(env, pool, app)
+	if err != nil || !assigned {
+		return nil, err
+	}
+
+	exists, err := a.configStore.AppExists(app, env)
+	if err != nil || !exists {
+		return nil, err
+	}
+
+	appCfg, err := a.configStore.GetApp(app, env)
+	if err != nil {
+		return nil, err
+	}
+
+	return &appInfo{
+		Name:      appCfg.Name,
+		ID:        appCfg.ID(),
+		Version:   appCfg.Version(),
+		VersionID: appCfg.VersionID(),
+		Ports:     appCfg.Ports(),
+		Processes: appCfg.GetProcesses(pool),
+		Memory:    appCfg.GetMemory(pool),
+		CPUShares: appCfg.GetCPUShares(pool),
+	}, nil
+}
+
+func (a *API) instances(env, pool, app string) (interface{}, error) {
+	assigned, err := a.assigned(env, pool, app)
+	if err != nil || !assigned || a.serviceRegistry == nil {
+		return nil, err
+	}
+
+	return a.serviceRegistry.ListAppRegistrations(env, pool, app)
+}
+
+func logLevel() map[string]string {
+	return map[string]string{"level": log.LevelName(log.Level())}
+}
+
+// NewAdminAPI returns the admin API, which changes the running process
+// rather than the config store:
+//
+//	POST /_loglevel?level=<debug|info|warn|error>
+//
+// It has no authentication, so it's served on its own listener, and only
+// when asked for.
+func NewAdminAPI() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/_loglevel", setLogLevel)
+	return mux
+}
+
+// ServeAdminAPI listens on addr and serves the admin API until it fails.
+func ServeAdminAPI(addr string) error {
+	log.Printf("Serving admin API on %s", addr)
+	return http.ListenAndServe(addr, NewAdminAPI())
+}
+
+// setLogLevel changes the log level without a restart.
+func setLogLevel(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	level, err := log.ParseLevel(r.FormValue("level"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if level != log.Level() {
+		log.Printf("Log level changed to %s by %s", log.LevelName(level), r.RemoteAddr)
+	}
+	log.SetLevel(level)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(logLevel())
+}
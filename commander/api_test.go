@@ -0,0 +1,149 @@
+package commander
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/litl/galaxy/log"
+)
+
+func TestAPIApp(t *testing.T) {
+	s, _ := NewTestStore()
+	if _, err := s.CreateApp("app", "dev"); err != nil {
+		t.Fatal(err)
+	}
+
+	ac, _ := s.GetApp("app", "dev")
+	ac.SetVersion("app:v1")
+	ac.EnvSet("PASSWORD", "secret")
+	s.UpdateApp(ac, "dev")
+	s.CreatePool("web", "dev")
+	s.AssignApp("app", "dev", "web")
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/dev/web/apps/app", nil)
+	NewAPI(s, nil).ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /dev/web/apps/app = %d, want %d", w.Code, http.StatusOK)
+	}
+
+	var body map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+
+	if body["version"] != "app:v1" {
+		t.Errorf("version = %v, want %q", body["version"], "app:v1")
+	}
+
+	if _, ok := body["env"]; ok {
+		t.Errorf("API should not expose the app environment")
+	}
+}
+
+func TestAPINotFound(t *testing.T) {
+	s, _ := NewTestStore()
+	s.CreateApp("app", "dev")
+	s.CreatePool("web", "dev")
+	s.CreatePool("worker", "dev")
+	s.AssignApp("app", "dev", "worker")
+
+	for _, p := range []string{"/dev/web/apps/missing", "/dev/web/apps/app", "/dev/web/apps/app/instances",
+		"/dev/web/app", "/a/b/c/d/e"} {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", p, nil)
+		NewAPI(s, nil).ServeHTTP(w, req)
+
+		if w.Code != http.StatusNotFound {
+			t.Errorf("GET %s = %d, want %d", p, w.Code, http.StatusNotFound)
+		}
+	}
+}
+
+func TestAPIStats(t *testing.T) {
+	s, _ := NewTestStore()
+	s.StaleReads = true
+	s.CreateApp("app", "dev")
+	s.GetApp("app", "dev")
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/_stats", nil)
+	NewAPI(s, nil).ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /_stats = %d, want %d", w.Code, http.StatusOK)
+	}
+
+	var body struct {
+		Cache map[string]int64 `json:"cache"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+
+	if body.Cache["refreshes"] == 0 {
+		t.Errorf("GET /_stats = %s, want the cache refreshes", w.Body.String())
+	}
+}
+
+func TestAPIReadOnly(t *testing.T) {
+	s, _ := NewTestStore()
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/envs", nil)
+	NewAPI(s, nil).ServeHTTP(w, req)
+
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST /envs = %d, want %d", w.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestAPILogLevel(t *testing.T) {
+	defer log.SetLevel(log.Level())
+	api := NewAPI(nil, nil)
+	admin := NewAdminAPI()
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/_loglevel?level=debug", nil)
+	api.ServeHTTP(w, req)
+
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("POST /_loglevel to the API = %d, want %d", w.Code, http.StatusMethodNotAllowed)
+	}
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/_loglevel?level=debug", nil)
+	admin.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("POST /_loglevel = %d, want %d", w.Code, http.StatusOK)
+	}
+
+	if log.Level() != log.DEBUG {
+		t.Errorf("Level() = %d, want %d", log.Level(), log.DEBUG)
+	}
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/_loglevel", nil)
+	api.ServeHTTP(w, req)
+
+	var body map[string]string
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+
+	if body["level"] != "debug" {
+		t.Errorf("GET /_loglevel = %v, want level debug", body)
+	}
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/_loglevel?level=loud", nil)
+	admin.ServeHTTP(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("POST /_loglevel?level=loud = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/litl/galaxy/config"
 	"github.com/litl/galaxy/log"
@@ -12,6 +13,9 @@ import (
 	"github.com/ryanuber/columnize"
 )
 
+// deployLockTTL bounds how long a crashed deploy can block other deploys.
+const deployLockTTL = 30 * time.Second
+
 func AppList(configStore *config.Store, env string) error {
 
 	envs := []string{env}
@@ -73,11 +77,6 @@ func AppList(configStore *config.Store, env string) error {
 }
 
 func AppCreate(configStore *config.Store, app, env string) error {
-	// Don't allow creating runtime hosts entries
-	if app == "hosts" {
-		return fmt.Errorf("could not create app: %s", app)
-	}
-
 	created, err := configStore.CreateApp(app, env)
 
 	if err != nil {
@@ -93,12 +92,6 @@ func AppCreate(configStore *config.Store, app, env string) error {
 }
 
 func AppDelete(configStore *config.Store, app, env string) error {
-
-	// Don't allow deleting runtime hosts entries
-	if app == "hosts" || app == "pools" {
-		return fmt.Errorf("could not delete app: %s", app)
-	}
-
 	deleted, err := configStore.DeleteApp(app, env)
 	if err != nil {
 		return fmt.Errorf("could not delete app: %s", err)
@@ -119,6 +112,15 @@ func AppDeploy(configStore *config.Store, serviceRuntime *runtime.ServiceRuntime
 		return fmt.Errorf("unable to pull %s. Has it been released yet?", version)
 	}
 
+	unlock, err := configStore.LockApp(app, env, deployLockTTL)
+	if err == config.ErrAppLocked {
+		return fmt.Errorf("unable to deploy app: another deploy of %s is in progress.", app)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to deploy app: %s.", err)
+	}
+	defer unlock()
+
 	svcCfg, err := configStore.GetApp(app, env)
 	if err != nil {
 		return fmt.Errorf("unable to deploy app: %s.", err)
@@ -147,6 +149,50 @@ func AppDeploy(configStore *config.Store, serviceRuntime *runtime.ServiceRuntime
 	return nil
 }
 
+func AppHistory(configStore *config.Store, app, env string) error {
+	versions, err := configStore.ListAppVersions(app, env)
+	if err != nil {
+		return fmt.Errorf("unable to list history: %s", err)
+	}
+
+	columns := []string{"CONFIG | VERSION | IMAGE ID"}
+	for _, v := range versions {
+		versionID := v.VersionID
+		if len(versionID) > 12 {
+			versionID = versionID[:12]
+		}
+
+		columns = append(columns, strings.Join([]string{
+			strconv.FormatInt(v.ID, 10),
+			v.Version,
+			versionID,
+		}, " | "))
+	}
+	output, _ := columnize.SimpleFormat(columns)
+	log.Println(output)
+	return nil
+}
+
+func AppRollback(configStore *config.Store, app, env, id string) error {
+	configID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid config id: %s", id)
+	}
+
+	updated, err := configStore.RollbackApp(app, env, configID)
+	if err == config.ErrAppLocked {
+		return fmt.Errorf("unable to rollback app: a deploy of %s is in progress.", app)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to rollback app: %s.", err)
+	}
+	if !updated {
+		return fmt.Errorf("%s NOT rolled back.", app)
+	}
+	log.Printf("Rolled back %s to config %s.\n", app, id)
+	return nil
+}
+
 func AppRestart(Store *config.Store, app, env string) error {
 	err := Store.NotifyRestart(app, env)
 	if err != nil {
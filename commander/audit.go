@@ -0,0 +1,31 @@
+package commander
+
+import (
+	"strings"
+	"time"
+
+	"github.com/litl/galaxy/config"
+	"github.com/litl/galaxy/log"
+	"github.com/ryanuber/columnize"
+)
+
+func AuditList(configStore *config.Store, env, auditLog string, limit int) error {
+	entries, err := configStore.ListAuditEntries(env, auditLog, limit)
+	if err != nil {
+		return err
+	}
+
+	columns := []string{"TIME | ACTOR | ACTION | TARGET"}
+	for _, e := range entries {
+		columns = append(columns, strings.Join([]string{
+			e.Time.Local().Format(time.RFC3339),
+			e.Actor,
+			e.Action,
+			e.Target,
+		}, " | "))
+	}
+
+	output, _ := columnize.SimpleFormat(columns)
+	log.Println(output)
+	return nil
+}
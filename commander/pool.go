@@ -0,0 +1,29 @@
+package commander
+
+import (
+	"fmt"
+
+	"github.com/litl/galaxy/config"
+	"github.com/litl/galaxy/log"
+	"github.com/litl/galaxy/registry"
+)
+
+// PoolClear removes every app from a pool, deleting the apps that aren't
+// assigned anywhere else along with their registrations in the pool.  The
+// registrations of every unassigned app are removed even if some deletes
+// fail.
+func PoolClear(configStore *config.Store, serviceRegistry *registry.ServiceRegistry, env, pool string) error {
+	apps, deleted, clearErr := configStore.DeletePoolApps(env, pool)
+
+	_, err := serviceRegistry.DeleteAppRegistrations(env, pool, apps...)
+	if err != nil {
+		return fmt.Errorf("could not remove registrations in pool %s: %s", pool, err)
+	}
+
+	if clearErr != nil {
+		return fmt.Errorf("could not clear pool %s: unassigned %d apps, deleted %d: %s", pool, len(apps), deleted, clearErr)
+	}
+
+	log.Printf("Unassigned %d apps from pool %s in env %s, deleted %d.\n", len(apps), pool, env, deleted)
+	return nil
+}
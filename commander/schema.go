@@ -0,0 +1,26 @@
+package commander
+
+import (
+	"github.com/litl/galaxy/log"
+	"github.com/litl/galaxy/registry"
+)
+
+func RegistryMigrate(serviceRegistry *registry.ServiceRegistry, dryRun bool) error {
+	changes, err := serviceRegistry.MigrateSchema(dryRun)
+	for _, change := range changes {
+		if dryRun {
+			log.Printf("Would %s", change)
+		} else {
+			log.Printf("Did %s", change)
+		}
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if len(changes) == 0 {
+		log.Printf("Registry schema is up to date at version %d.", registry.SchemaVersion)
+	}
+	return nil
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/litl/galaxy/utils"
 )
@@ -16,6 +17,10 @@ type AppConfig struct {
 	environmentVMap *utils.VersionedMap
 	portsVMap       *utils.VersionedMap
 	runtimeVMap     *utils.VersionedMap
+
+	// staleSince is when a config served from the Store's cache while
+	// redis was unreachable was read.
+	staleSince time.Time
 }
 
 func NewAppConfig(app, version string) *AppConfig {
@@ -99,6 +104,12 @@ func (s *AppConfig) AddPort(port, portType string) {
 	s.portsVMap.Set(port, portType)
 }
 
+// StaleSince returns when the config was read from redis if it was served
+// from the Store's cache because redis was unreachable, or the zero time.
+func (s *AppConfig) StaleSince() time.Time {
+	return s.staleSince
+}
+
 func (s *AppConfig) ID() int64 {
 	id := int64(0)
 	for _, vmap := range []*utils.VersionedMap{
@@ -0,0 +1,54 @@
+package config
+
+import (
+	"time"
+
+	"github.com/litl/galaxy/log"
+)
+
+// AuditSize is the number of entries kept in each of an env's audit logs.
+const AuditSize = 1000
+
+// RegistryAuditLog names the audit log of service registrations.  They churn
+// far more than app and pool changes, so they're kept apart from env's main
+// log, which is named "", rather than pushing those changes out of it.
+const RegistryAuditLog = "registry"
+
+// AuditEntry records a change made by Actor to Target, such as an app, pool
+// or registration.
+type AuditEntry struct {
+	Time   time.Time `json:"time"`
+	Actor  string    `json:"actor"`
+	Action string    `json:"action"`
+	Target string    `json:"target"`
+}
+
+// Audit appends an entry to env's audit log.  It's best effort: a failure is
+// logged rather than returned, so it never fails the change being recorded.
+func (r *Store) Audit(env, action, target string) {
+	r.audit(env, "", action, target)
+}
+
+// AuditRegistry appends an entry to env's RegistryAuditLog, as Audit does.
+func (r *Store) AuditRegistry(env, action, target string) {
+	r.audit(env, RegistryAuditLog, action, target)
+}
+
+func (r *Store) audit(env, auditLog, action, target string) {
+	entry := &AuditEntry{
+		Time:   time.Now().UTC(),
+		Actor:  r.Actor,
+		Action: action,
+		Target: target,
+	}
+
+	if err := r.Backend.AddAuditEntry(env, auditLog, entry); err != nil {
+		log.Warnf("WARN: Unable to audit %s %s: %s", action, target, err)
+	}
+}
+
+// ListAuditEntries returns up to limit of the entries in env's auditLog,
+// newest first.  A limit of 0 returns all of them.
+func (r *Store) ListAuditEntries(env, auditLog string, limit int) ([]*AuditEntry, error) {
+	return r.Backend.ListAuditEntries(env, auditLog, limit)
+}
@@ -1,5 +1,13 @@
 package config
 
+import (
+	"errors"
+	"time"
+)
+
+// ErrAppLocked is returned by LockApp when the lock is already held.
+var ErrAppLocked = errors.New("another deploy is in progress")
+
 type Backend interface {
 	// Apps
 	AppExists(app, env string) (bool, error)
@@ -8,10 +16,12 @@ type Backend interface {
 	GetApp(app, env string) (*AppConfig, error)
 	UpdateApp(svcCfg *AppConfig, env string) (bool, error)
 	DeleteApp(svcCfg *AppConfig, env string) (bool, error)
+	ListAppVersions(app, env string) ([]*AppVersion, error)
 
 	// Pools
 	AssignApp(app, env, pool string) (bool, error)
 	UnassignApp(app, env, pool string) (bool, error)
+	UnassignApps(env, pool string, apps ...string) (int, error)
 	ListAssignments(env, pool string) ([]string, error)
 	CreatePool(env, pool string) (bool, error)
 	DeletePool(env, pool string) (bool, error)
@@ -25,6 +35,13 @@ type Backend interface {
 	ListHosts(env, pool string) ([]HostInfo, error)
 	DeleteHost(env, pool string, host HostInfo) error
 
+	// Audit
+	AddAuditEntry(env, auditLog string, entry *AuditEntry) error
+	ListAuditEntries(env, auditLog string, limit int) ([]*AuditEntry, error)
+
+	// Locks
+	LockApp(app, env string, ttl time.Duration) (func() error, error)
+
 	//Pub/Sub
 	Subscribe(key string) chan string
 	Notify(key, value string) (int, error)
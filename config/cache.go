@@ -0,0 +1,154 @@
+package config
+
+import (
+	"io"
+	"net"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/litl/galaxy/log"
+)
+
+// DefaultMaxStale is how old a cached config can be and still be served
+// while redis is unreachable.
+const DefaultMaxStale = 5 * time.Minute
+
+// CacheStats counts how reads were served when StaleReads is set.
+type CacheStats struct {
+	// Refreshes are live reads that updated the cache.
+	Refreshes int64 `json:"refreshes"`
+	// StaleServes are failed reads answered from the cache.
+	StaleServes int64 `json:"staleServes"`
+	// Misses are failed reads with nothing recent enough cached.
+	Misses int64 `json:"misses"`
+}
+
+type cachedApps struct {
+	apps   []*AppConfig
+	readAt time.Time
+}
+
+// appCache keeps the last config read from redis for each app, and each
+// env's app list, keyed by env and app.
+type appCache struct {
+	sync.Mutex
+	apps  map[string]cachedApps
+	stats CacheStats
+}
+
+// isConnError reports whether err means redis couldn't be reached, as
+// opposed to a bad or missing value.
+func isConnError(err error) bool {
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+	return err == io.EOF || err == io.ErrUnexpectedEOF
+}
+
+// copyAppConfig returns a deep copy of svcCfg so callers can't modify the
+// cached config.
+func copyAppConfig(svcCfg *AppConfig) *AppConfig {
+	c := NewAppConfig(svcCfg.Name, "")
+	c.versionVMap.UnmarshalMap(svcCfg.versionVMap.MarshalMap())
+	c.environmentVMap.UnmarshalMap(svcCfg.environmentVMap.MarshalMap())
+	c.portsVMap.UnmarshalMap(svcCfg.portsVMap.MarshalMap())
+	c.runtimeVMap.UnmarshalMap(svcCfg.runtimeVMap.MarshalMap())
+	return c
+}
+
+func copyAppConfigs(apps []*AppConfig) []*AppConfig {
+	copies := []*AppConfig{}
+	for _, svcCfg := range apps {
+		copies = append(copies, copyAppConfig(svcCfg))
+	}
+	return copies
+}
+
+// update records the result of a live read.  A value replaces the cached
+// one, and any other error, such as a missing app, drops it.  Connection
+// errors leave the cache alone.
+func (c *appCache) update(key string, apps []*AppConfig, err error) {
+	if err != nil && isConnError(err) {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	if c.apps == nil {
+		c.apps = make(map[string]cachedApps)
+	}
+
+	if err != nil {
+		delete(c.apps, key)
+		return
+	}
+
+	c.apps[key] = cachedApps{apps: copyAppConfigs(apps), readAt: time.Now()}
+	c.stats.Refreshes++
+}
+
+// invalidate drops the cached configs of apps, and the app list of env, so a
+// process that has just written them can't be served what they replaced.
+func (c *appCache) invalidate(env string, apps ...string) {
+	c.Lock()
+	defer c.Unlock()
+
+	delete(c.apps, env)
+	for _, app := range apps {
+		delete(c.apps, path.Join(env, app))
+	}
+}
+
+// stale returns copies of the cached configs for key, marked stale, and
+// when they were read, if that was within maxStale.
+func (c *appCache) stale(key string, maxStale time.Duration) ([]*AppConfig, time.Time, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	cached, ok := c.apps[key]
+	if !ok || time.Since(cached.readAt) > maxStale {
+		c.stats.Misses++
+		return nil, time.Time{}, false
+	}
+
+	c.stats.StaleServes++
+	apps := copyAppConfigs(cached.apps)
+	for _, svcCfg := range apps {
+		svcCfg.staleSince = cached.readAt
+	}
+	return apps, cached.readAt, true
+}
+
+// readThrough runs read and caches its result when StaleReads is set.  If
+// redis can't be reached, it returns the cached result instead of the error.
+func (r *Store) readThrough(key string, read func() ([]*AppConfig, error)) ([]*AppConfig, error) {
+	apps, err := read()
+	if !r.StaleReads {
+		return apps, err
+	}
+
+	r.cache.update(key, apps, err)
+	if err == nil || !isConnError(err) {
+		return apps, err
+	}
+
+	maxStale := r.MaxStale
+	if maxStale <= 0 {
+		maxStale = DefaultMaxStale
+	}
+
+	if cached, readAt, ok := r.cache.stale(key, maxStale); ok {
+		log.Warnf("WARN: Serving %s config read %s ago: %s", key, time.Since(readAt), err)
+		return cached, nil
+	}
+	return apps, err
+}
+
+// CacheStats returns how reads have been served by the stale cache.
+func (r *Store) CacheStats() CacheStats {
+	r.cache.Lock()
+	defer r.cache.Unlock()
+	return r.cache.stats
+}
@@ -0,0 +1,142 @@
+package config
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Encrypted environment values are stored as enc:v1:<key id>:<base64 nonce+ciphertext>.
+// Values without the prefix were written before encryption was enabled and are
+// returned as-is.
+const encryptedPrefix = "enc:v1:"
+
+type envCipher struct {
+	writeID string
+	aeads   map[string]cipher.AEAD
+}
+
+// ParseEnvKeys parses a comma separated list of base64 encoded AES keys, as
+// found in GALAXY_ENV_KEYS.  The first key is used to encrypt, all keys are
+// used to decrypt so that keys can be rotated.  Values are re-encrypted with
+// the first key when their app's config is next saved.
+func ParseEnvKeys(s string) ([][]byte, error) {
+	keys := [][]byte{}
+	for _, k := range strings.Split(s, ",") {
+		k = strings.TrimSpace(k)
+		if k == "" {
+			continue
+		}
+
+		key, err := base64.StdEncoding.DecodeString(k)
+		if err != nil {
+			return nil, fmt.Errorf("invalid env key: %s", err)
+		}
+
+		switch len(key) {
+		case 16, 24, 32:
+		default:
+			return nil, fmt.Errorf("invalid env key: must be 16, 24 or 32 bytes, got %d", len(key))
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func envKeyID(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:4])
+}
+
+func newEnvCipher(keys [][]byte) (*envCipher, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	c := &envCipher{
+		writeID: envKeyID(keys[0]),
+		aeads:   make(map[string]cipher.AEAD),
+	}
+
+	for _, key := range keys {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		c.aeads[envKeyID(key)] = aead
+	}
+	return c, nil
+}
+
+func (c *envCipher) encrypt(value string) (string, error) {
+	aead := c.aeads[c.writeID]
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+
+	sealed := aead.Seal(nonce, nonce, []byte(value), nil)
+	return encryptedPrefix + c.writeID + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// current reports whether value is encrypted with the key c encrypts with.
+func (c *envCipher) current(value string) bool {
+	return strings.HasPrefix(value, encryptedPrefix+c.writeID+":")
+}
+
+// decryptEnvValue returns value decrypted if it carries the encrypted prefix.
+// c may be nil, in which case only plaintext values can be read.
+func decryptEnvValue(c *envCipher, value string) (string, error) {
+	if !strings.HasPrefix(value, encryptedPrefix) {
+		return value, nil
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(value, encryptedPrefix), ":", 2)
+	if len(parts) != 2 {
+		return "", fmt.Errorf("malformed encrypted value")
+	}
+
+	if c == nil {
+		return "", fmt.Errorf("value is encrypted with key %s but no env keys are configured", parts[0])
+	}
+
+	aead, ok := c.aeads[parts[0]]
+	if !ok {
+		return "", fmt.Errorf("value is encrypted with unknown key %s", parts[0])
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", fmt.Errorf("malformed encrypted value: %s", err)
+	}
+
+	if len(sealed) < aead.NonceSize() {
+		return "", fmt.Errorf("malformed encrypted value")
+	}
+
+	plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return "", fmt.Errorf("unable to decrypt value with key %s: %s", parts[0], err)
+	}
+	return string(plain), nil
+}
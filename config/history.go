@@ -0,0 +1,69 @@
+package config
+
+import (
+	"github.com/litl/galaxy/utils"
+)
+
+// HistorySize is the number of prior configs kept for each app.
+const HistorySize = 20
+
+// AppVersion is a snapshot of an app's config as it was written by
+// UpdateApp.  ID is the AppConfig ID at the time of the write.
+type AppVersion struct {
+	ID        int64             `json:"id"`
+	Version   string            `json:"version"`
+	VersionID string            `json:"versionID"`
+	Env       map[string]string `json:"env"`
+	Ports     map[string]string `json:"ports"`
+	Runtime   map[string]string `json:"runtime"`
+}
+
+func vmapValues(vmap *utils.VersionedMap) map[string]string {
+	values := map[string]string{}
+	for _, k := range vmap.Keys() {
+		if v := vmap.Get(k); v != "" {
+			values[k] = v
+		}
+	}
+	return values
+}
+
+// restoreVMap sets vmap to exactly values at version id, unsetting any keys
+// that values does not contain.
+func restoreVMap(vmap *utils.VersionedMap, values map[string]string, id int64) {
+	for _, k := range vmap.Keys() {
+		if _, ok := values[k]; !ok && vmap.Get(k) != "" {
+			vmap.UnSetVersion(k, id)
+		}
+	}
+
+	for k, v := range values {
+		if vmap.Get(k) != v {
+			vmap.SetVersion(k, v, id)
+		}
+	}
+}
+
+func newAppVersion(svcCfg *AppConfig) *AppVersion {
+	return &AppVersion{
+		ID:        svcCfg.ID(),
+		Version:   svcCfg.Version(),
+		VersionID: svcCfg.VersionID(),
+		Env:       vmapValues(svcCfg.environmentVMap),
+		Ports:     vmapValues(svcCfg.portsVMap),
+		Runtime:   vmapValues(svcCfg.runtimeVMap),
+	}
+}
+
+// Restore applies a prior version on top of svcCfg as a new change, so the
+// result still merges correctly with concurrent writes.
+func (v *AppVersion) Restore(svcCfg *AppConfig) {
+	id := svcCfg.nextID()
+	restoreVMap(svcCfg.versionVMap, map[string]string{
+		"version":   v.Version,
+		"versionID": v.VersionID,
+	}, id)
+	restoreVMap(svcCfg.environmentVMap, v.Env, id)
+	restoreVMap(svcCfg.portsVMap, v.Ports, id)
+	restoreVMap(svcCfg.runtimeVMap, v.Runtime, id)
+}
@@ -1,8 +1,11 @@
 package config
 
 import (
+	"path"
 	"regexp"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/litl/galaxy/utils"
 )
@@ -13,16 +16,22 @@ type Value struct {
 }
 
 type MemoryBackend struct {
+	// guards apps, history, locks and audit, which watchers, deploys and
+	// audited writes use concurrently
+	sync.Mutex
 	maps        map[string]map[string]string
 	apps        map[string][]*AppConfig // env -> []app
 	assignments map[string][]string
+	locks       map[string]bool
+	history     map[string][]*AppVersion
+	audit       map[string][]*AuditEntry
 
 	AppExistsFunc       func(app, env string) (bool, error)
 	CreateAppFunc       func(app, env string) (bool, error)
 	GetAppFunc          func(app, env string) (*AppConfig, error)
 	UpdateAppFunc       func(svcCfg *AppConfig, env string) (bool, error)
 	DeleteAppFunc       func(svcCfg *AppConfig, env string) (bool, error)
-	ListAppFunc         func(env string) ([]AppConfig, error)
+	ListAppsFunc        func(env string) ([]*AppConfig, error)
 	AssignAppFunc       func(app, env, pool string) (bool, error)
 	UnassignAppFunc     func(app, env, pool string) (bool, error)
 	ListAssignmentsFunc func(env, pool string) ([]string, error)
@@ -38,6 +47,8 @@ type MemoryBackend struct {
 	RemoveMemberFunc func(key, value string) (int, error)
 	NotifyFunc       func(key, value string) (int, error)
 	SetMultiFunc     func(key string, values map[string]string) (string, error)
+
+	AddAuditEntryFunc func(env, auditLog string, entry *AuditEntry) error
 }
 
 func NewMemoryBackend() *MemoryBackend {
@@ -45,6 +56,9 @@ func NewMemoryBackend() *MemoryBackend {
 		maps:        make(map[string]map[string]string),
 		apps:        make(map[string][]*AppConfig),
 		assignments: make(map[string][]string),
+		locks:       make(map[string]bool),
+		history:     make(map[string][]*AppVersion),
+		audit:       make(map[string][]*AuditEntry),
 	}
 }
 
@@ -53,12 +67,18 @@ func (r *MemoryBackend) AppExists(app, env string) (bool, error) {
 		return r.AppExistsFunc(app, env)
 	}
 
+	r.Lock()
+	defer r.Unlock()
+	return r.appExists(app, env), nil
+}
+
+func (r *MemoryBackend) appExists(app, env string) bool {
 	for _, s := range r.apps[env] {
 		if s.Name == app {
-			return true, nil
+			return true
 		}
 	}
-	return false, nil
+	return false
 }
 
 func (r *MemoryBackend) CreateApp(app, env string) (bool, error) {
@@ -67,7 +87,10 @@ func (r *MemoryBackend) CreateApp(app, env string) (bool, error) {
 		return r.CreateAppFunc(app, env)
 	}
 
-	if exists, err := r.AppExists(app, env); !exists && err == nil {
+	r.Lock()
+	defer r.Unlock()
+
+	if !r.appExists(app, env) {
 		r.apps[env] = append(r.apps[env], NewAppConfig(app, ""))
 		return true, nil
 	}
@@ -76,6 +99,12 @@ func (r *MemoryBackend) CreateApp(app, env string) (bool, error) {
 }
 
 func (r *MemoryBackend) ListApps(env string) ([]*AppConfig, error) {
+	if r.ListAppsFunc != nil {
+		return r.ListAppsFunc(env)
+	}
+
+	r.Lock()
+	defer r.Unlock()
 	return r.apps[env], nil
 }
 
@@ -84,6 +113,9 @@ func (r *MemoryBackend) GetApp(app, env string) (*AppConfig, error) {
 		return r.GetAppFunc(app, env)
 	}
 
+	r.Lock()
+	defer r.Unlock()
+
 	for _, cfg := range r.apps[env] {
 		if cfg.Name == app {
 			return cfg, nil
@@ -96,7 +128,58 @@ func (r *MemoryBackend) UpdateApp(svcCfg *AppConfig, env string) (bool, error) {
 	if r.UpdateAppFunc != nil {
 		return r.UpdateAppFunc(svcCfg, env)
 	}
-	return false, nil
+
+	r.Lock()
+	defer r.Unlock()
+
+	cfgs := []*AppConfig{svcCfg}
+	for _, cfg := range r.apps[env] {
+		if cfg.Name != svcCfg.Name {
+			cfgs = append(cfgs, cfg)
+		}
+	}
+	r.apps[env] = cfgs
+
+	key := env + "/" + svcCfg.Name
+	r.history[key] = append([]*AppVersion{newAppVersion(svcCfg)}, r.history[key]...)
+	if len(r.history[key]) > HistorySize {
+		r.history[key] = r.history[key][:HistorySize]
+	}
+	return true, nil
+}
+
+func (r *MemoryBackend) ListAppVersions(app, env string) ([]*AppVersion, error) {
+	r.Lock()
+	defer r.Unlock()
+	return r.history[env+"/"+app], nil
+}
+
+func (r *MemoryBackend) AddAuditEntry(env, auditLog string, entry *AuditEntry) error {
+	if r.AddAuditEntryFunc != nil {
+		return r.AddAuditEntryFunc(env, auditLog, entry)
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	key := path.Join(env, auditLog)
+	entries := append([]*AuditEntry{entry}, r.audit[key]...)
+	if len(entries) > AuditSize {
+		entries = entries[:AuditSize]
+	}
+	r.audit[key] = entries
+	return nil
+}
+
+func (r *MemoryBackend) ListAuditEntries(env, auditLog string, limit int) ([]*AuditEntry, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	entries := r.audit[path.Join(env, auditLog)]
+	if limit > 0 && len(entries) > limit {
+		entries = entries[:limit]
+	}
+	return entries, nil
 }
 
 func (r *MemoryBackend) DeleteApp(svcCfg *AppConfig, env string) (bool, error) {
@@ -104,6 +187,9 @@ func (r *MemoryBackend) DeleteApp(svcCfg *AppConfig, env string) (bool, error) {
 		return r.DeleteAppFunc(svcCfg, env)
 	}
 
+	r.Lock()
+	defer r.Unlock()
+
 	cfgs := []*AppConfig{}
 	for _, cfg := range r.apps[env] {
 		if cfg.Name != svcCfg.Name {
@@ -141,6 +227,20 @@ func (r *MemoryBackend) UnassignApp(app, env, pool string) (bool, error) {
 	return true, nil
 }
 
+func (r *MemoryBackend) UnassignApps(env, pool string, apps ...string) (int, error) {
+	removed := 0
+	for _, app := range apps {
+		unassigned, err := r.UnassignApp(app, env, pool)
+		if err != nil {
+			return removed, err
+		}
+		if unassigned {
+			removed++
+		}
+	}
+	return removed, nil
+}
+
 func (r *MemoryBackend) ListAssignments(env, pool string) ([]string, error) {
 	if r.ListAssignmentsFunc != nil {
 		return r.ListAssignmentsFunc(env, pool)
@@ -199,6 +299,24 @@ func (r *MemoryBackend) ListEnvs() ([]string, error) {
 	return p, nil
 }
 
+func (r *MemoryBackend) LockApp(app, env string, ttl time.Duration) (func() error, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	key := env + "/" + app
+	if r.locks[key] {
+		return nil, ErrAppLocked
+	}
+
+	r.locks[key] = true
+	return func() error {
+		r.Lock()
+		defer r.Unlock()
+		delete(r.locks, key)
+		return nil
+	}, nil
+}
+
 func (r *MemoryBackend) Connect() {
 }
 
@@ -62,12 +62,16 @@ func (r *Store) checkForChanges(env string) {
 }
 
 func (r *Store) checkForChangePeriodically(stop chan struct{}) {
-	// TODO: default polling interval
-	ticker := time.NewTicker(10 * time.Second)
+	interval := r.PollInterval
+	if interval <= 0 {
+		interval = DefaultPollInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
 	for {
 		select {
 		case <-stop:
-			ticker.Stop()
 			return
 		case <-ticker.C:
 			r.CheckForChangesNow()
@@ -1,9 +1,12 @@
 package config
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
 	"path"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -12,9 +15,22 @@ import (
 	"github.com/litl/galaxy/utils"
 )
 
+// unlockScript releases a lock only if it still holds the token it was
+// acquired with, so an expired lock taken over by someone else is left alone.
+var unlockScript = redis.NewScript(1, `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
 type RedisBackend struct {
 	redisPool redis.Pool
 	RedisHost string
+
+	// envCipher, when set, encrypts app environments at rest.  It's built
+	// once by Store.Connect from the Store's EnvKeys.
+	envCipher *envCipher
 }
 
 func (r *RedisBackend) AppExists(app, env string) (bool, error) {
@@ -31,13 +47,11 @@ func (r *RedisBackend) CreateApp(app, env string) (bool, error) {
 }
 
 func (r *RedisBackend) ListApps(env string) ([]*AppConfig, error) {
-	// TODO: convert to scan
-	apps, err := r.Keys(path.Join(env, "*", "version"))
+	apps, err := r.Scan(path.Join(env, "*", "version"))
 	if err != nil {
 		return nil, err
 	}
 
-	// TODO: is it OK to error out early?
 	var appList []*AppConfig
 	for _, app := range apps {
 		parts := strings.Split(app, "/")
@@ -52,11 +66,19 @@ func (r *RedisBackend) ListApps(env string) ([]*AppConfig, error) {
 			continue
 		}
 
+		// an app that can't be read, such as one with a corrupt field,
+		// is skipped so it doesn't stop every other app in env; losing
+		// redis still fails the whole list
 		cfg, err := r.GetApp(parts[1], env)
-		if err != nil {
+		if err != nil && isConnError(err) {
 			return nil, err
 		}
 
+		if err != nil {
+			log.Printf("WARN: Skipping app %s in %s: %s\n", parts[1], env, err)
+			continue
+		}
+
 		appList = append(appList, cfg)
 	}
 
@@ -78,7 +100,7 @@ func (r *RedisBackend) UpdateApp(svcCfg *AppConfig, env string) (bool, error) {
 	}
 
 	//TODO: user MULTI/EXEC
-	err := r.SaveVMap(path.Join(env, svcCfg.Name, "environment"),
+	err := r.saveEnvVMap(path.Join(env, svcCfg.Name, "environment"),
 		svcCfg.environmentVMap)
 
 	if err != nil {
@@ -105,13 +127,142 @@ func (r *RedisBackend) UpdateApp(svcCfg *AppConfig, env string) (bool, error) {
 	if err != nil {
 		return false, err
 	}
+
+	err = r.addAppVersion(svcCfg, env)
+	if err != nil {
+		return false, err
+	}
 	return true, nil
 }
 
+// addAppVersion pushes a snapshot of svcCfg onto the app's history list,
+// trimming it to HistorySize entries.  Snapshots include the environment so
+// they are encrypted like it when env keys are configured.
+func (r *RedisBackend) addAppVersion(svcCfg *AppConfig, env string) error {
+	b, err := json.Marshal(newAppVersion(svcCfg))
+	if err != nil {
+		return err
+	}
+	entry := string(b)
+
+	if r.envCipher != nil {
+		entry, err = r.envCipher.encrypt(entry)
+		if err != nil {
+			return err
+		}
+	}
+
+	conn := r.redisPool.Get()
+	defer conn.Close()
+
+	if conn.Err() != nil {
+		conn.Close()
+		r.Reconnect()
+		return conn.Err()
+	}
+
+	key := path.Join(env, svcCfg.Name, "history")
+	conn.Send("MULTI")
+	conn.Send("LPUSH", key, entry)
+	conn.Send("LTRIM", key, "0", strconv.Itoa(HistorySize-1))
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+// auditKey is the list holding env's auditLog.  The main log, "", is kept at
+// env/audit.
+func auditKey(env, auditLog string) string {
+	return path.Join(env, "audit", auditLog)
+}
+
+// AddAuditEntry pushes entry onto env's auditLog list, trimming it to
+// AuditSize entries.
+func (r *RedisBackend) AddAuditEntry(env, auditLog string, entry *AuditEntry) error {
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	conn := r.redisPool.Get()
+	defer conn.Close()
+
+	if conn.Err() != nil {
+		conn.Close()
+		r.Reconnect()
+		return conn.Err()
+	}
+
+	key := auditKey(env, auditLog)
+	conn.Send("MULTI")
+	conn.Send("LPUSH", key, string(b))
+	conn.Send("LTRIM", key, "0", strconv.Itoa(AuditSize-1))
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+func (r *RedisBackend) ListAuditEntries(env, auditLog string, limit int) ([]*AuditEntry, error) {
+	conn := r.redisPool.Get()
+	defer conn.Close()
+
+	if conn.Err() != nil {
+		conn.Close()
+		r.Reconnect()
+		return nil, conn.Err()
+	}
+
+	entries, err := redis.Strings(conn.Do("LRANGE", auditKey(env, auditLog), "0", strconv.Itoa(limit-1)))
+	if err != nil && err != redis.ErrNil {
+		return nil, err
+	}
+
+	audit := []*AuditEntry{}
+	for _, e := range entries {
+		entry := &AuditEntry{}
+		if err := json.Unmarshal([]byte(e), entry); err != nil {
+			return nil, fmt.Errorf("unable to read audit log of %s: %s", env, err)
+		}
+		audit = append(audit, entry)
+	}
+	return audit, nil
+}
+
+// ListAppVersions returns the saved configs of app, newest first.
+func (r *RedisBackend) ListAppVersions(app, env string) ([]*AppVersion, error) {
+	conn := r.redisPool.Get()
+	defer conn.Close()
+
+	if conn.Err() != nil {
+		conn.Close()
+		r.Reconnect()
+		return nil, conn.Err()
+	}
+
+	entries, err := redis.Strings(conn.Do("LRANGE", path.Join(env, app, "history"), "0", "-1"))
+	if err != nil && err != redis.ErrNil {
+		return nil, err
+	}
+
+	versions := []*AppVersion{}
+	for _, entry := range entries {
+		entry, err = decryptEnvValue(r.envCipher, entry)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read history of %s: %s", app, err)
+		}
+
+		version := &AppVersion{}
+		err = json.Unmarshal([]byte(entry), version)
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, version)
+	}
+	return versions, nil
+}
+
 func (r *RedisBackend) GetApp(app, env string) (*AppConfig, error) {
 	svcCfg := NewAppConfig(path.Base(app), "")
 
-	err := r.LoadVMap(path.Join(env, app, "environment"), svcCfg.environmentVMap)
+	err := r.loadEnvVMap(path.Join(env, app, "environment"), svcCfg.environmentVMap)
 	if err != nil {
 		return nil, err
 	}
@@ -141,7 +292,7 @@ func (r *RedisBackend) DeleteApp(svcCfg *AppConfig, env string) (bool, error) {
 
 	deletedOne = deletedOne || deleted == 1
 
-	for _, k := range []string{"environment", "version", "ports", "runtime"} {
+	for _, k := range []string{"environment", "version", "ports", "runtime", "history"} {
 		deleted, err = r.Delete(path.Join(env, svcCfg.Name, k))
 		if err != nil {
 			return false, err
@@ -165,6 +316,26 @@ func (r *RedisBackend) UnassignApp(app, env, pool string) (bool, error) {
 	return removed == 1, err
 }
 
+// UnassignApps removes apps from pool in one SREM, and returns how many were
+// assigned.
+func (r *RedisBackend) UnassignApps(env, pool string, apps ...string) (int, error) {
+	if len(apps) == 0 {
+		return 0, nil
+	}
+
+	conn := r.redisPool.Get()
+	defer conn.Close()
+
+	if conn.Err() != nil {
+		conn.Close()
+		r.Reconnect()
+		return 0, conn.Err()
+	}
+
+	redisArgs := redis.Args{}.Add(path.Join(env, "pools", pool)).AddFlat(apps)
+	return redis.Int(conn.Do("SREM", redisArgs...))
+}
+
 func (r *RedisBackend) ListAssignments(env, pool string) ([]string, error) {
 	return r.Members(path.Join(env, "pools", pool))
 }
@@ -190,7 +361,7 @@ func (r *RedisBackend) ListPools(env string) ([]string, error) {
 	// when it starts up.  It can dynamically create
 	// a pool
 	key := path.Join(env, "*", "hosts", "*", "info")
-	keys, err := r.Keys(key)
+	keys, err := r.Scan(key)
 	if err != nil {
 		return nil, err
 	}
@@ -210,7 +381,7 @@ func (r *RedisBackend) ListPools(env string) ([]string, error) {
 	// has no running hosts so we add these to the pools
 	// list as well.
 	key = path.Join(env, "pools", "*")
-	keys, err = r.Keys(key)
+	keys, err = r.Scan(key)
 	if err != nil {
 		return nil, err
 	}
@@ -232,7 +403,7 @@ func (r *RedisBackend) ListPools(env string) ([]string, error) {
 
 func (r *RedisBackend) ListEnvs() ([]string, error) {
 	envs := []string{}
-	apps, err := r.Keys(path.Join("*", "*", "environment"))
+	apps, err := r.Scan(path.Join("*", "*", "environment"))
 	if err != nil {
 		return nil, err
 	}
@@ -246,19 +417,66 @@ func (r *RedisBackend) ListEnvs() ([]string, error) {
 	return envs, nil
 }
 
+// LockApp takes an advisory lock on app that expires after ttl.  The returned
+// func releases the lock.  ErrAppLocked is returned if the lock is held.
+func (r *RedisBackend) LockApp(app, env string, ttl time.Duration) (func() error, error) {
+	key := path.Join(env, "locks", app)
+
+	token, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+
+	conn := r.redisPool.Get()
+	defer conn.Close()
+
+	if conn.Err() != nil {
+		conn.Close()
+		r.Reconnect()
+		return nil, conn.Err()
+	}
+
+	ms := strconv.FormatInt(int64(ttl/time.Millisecond), 10)
+	reply, err := conn.Do("SET", key, token, "NX", "PX", ms)
+	if err != nil {
+		return nil, err
+	}
+
+	// SET NX returns nil when the key already exists
+	if reply == nil {
+		return nil, ErrAppLocked
+	}
+
+	unlock := func() error {
+		conn := r.redisPool.Get()
+		defer conn.Close()
+
+		if conn.Err() != nil {
+			conn.Close()
+			r.Reconnect()
+			return conn.Err()
+		}
+
+		_, err := unlockScript.Do(conn, key, token)
+		return err
+	}
+	return unlock, nil
+}
+
 func (r *RedisBackend) LoadVMap(key string, dest *utils.VersionedMap) error {
 	serialized, err := r.GetAll(key)
 	if err != nil {
 		return err
 	}
 
-	dest.UnmarshalMap(serialized)
-	return nil
+	return dest.UnmarshalMap(serialized)
 }
 
 func (r *RedisBackend) SaveVMap(key string, vmap *utils.VersionedMap) error {
+	return r.saveSerializedVMap(key, vmap.MarshalMap(), vmap)
+}
 
-	serialized := vmap.MarshalMap()
+func (r *RedisBackend) saveSerializedVMap(key string, serialized map[string]string, vmap *utils.VersionedMap) error {
 	if len(serialized) == 0 {
 		return nil
 	}
@@ -273,8 +491,64 @@ func (r *RedisBackend) SaveVMap(key string, vmap *utils.VersionedMap) error {
 		return errors.New("not saved")
 	}
 
-	r.GcVMap(key, vmap)
-	return nil
+	return r.GcVMap(key, vmap)
+}
+
+// loadEnvVMap is LoadVMap for app environments, decrypting values that were
+// written with one of the env keys.
+func (r *RedisBackend) loadEnvVMap(key string, dest *utils.VersionedMap) error {
+	serialized, err := r.GetAll(key)
+	if err != nil {
+		return err
+	}
+
+	for k, v := range serialized {
+		serialized[k], err = decryptEnvValue(r.envCipher, v)
+		if err != nil {
+			return fmt.Errorf("unable to read %s: %s", key, err)
+		}
+	}
+
+	return dest.UnmarshalMap(serialized)
+}
+
+// saveEnvVMap is SaveVMap for app environments, encrypting values when env
+// keys are configured.  Each serialized field holds one version of a value,
+// so only fields that aren't stored yet are encrypted and written, along with
+// stored fields that are plaintext or encrypted with a key other than the
+// current one.  Saving an app's config after a key rotation re-encrypts it,
+// after which the retired key can be dropped.
+func (r *RedisBackend) saveEnvVMap(key string, vmap *utils.VersionedMap) error {
+	stored, err := r.GetAll(key)
+	if err != nil {
+		return err
+	}
+
+	serialized := vmap.MarshalMap()
+	for k, v := range stored {
+		if r.envCipher == nil || v == "" || r.envCipher.current(v) {
+			delete(serialized, k)
+		}
+	}
+
+	if r.envCipher != nil {
+		for k, v := range serialized {
+			// empty values mark unset keys and stay as they are
+			if v == "" {
+				continue
+			}
+
+			serialized[k], err = r.envCipher.encrypt(v)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(serialized) == 0 {
+		return r.GcVMap(key, vmap)
+	}
+	return r.saveSerializedVMap(key, serialized, vmap)
 }
 
 func (r *RedisBackend) GcVMap(key string, vmap *utils.VersionedMap) error {
@@ -285,15 +559,12 @@ func (r *RedisBackend) GcVMap(key string, vmap *utils.VersionedMap) error {
 			keys = append(keys, k)
 		}
 
-		deleted, err := r.DeleteMulti(key, keys...)
-
+		// fewer deletions than keys just means another writer already
+		// collected some of them
+		_, err := r.DeleteMulti(key, keys...)
 		if err != nil {
 			return err
 		}
-
-		if deleted != 1 {
-			return errors.New("not deleted")
-		}
 	}
 	return nil
 }
@@ -323,6 +594,55 @@ func (r *RedisBackend) Reconnect() {
 	r.Connect()
 }
 
+// Scan returns the keys matching pattern.  It iterates with SCAN rather
+// than KEYS so listing a large keyspace doesn't block redis.
+func (r *RedisBackend) Scan(pattern string) ([]string, error) {
+	conn := r.redisPool.Get()
+	defer conn.Close()
+
+	if conn.Err() != nil {
+		conn.Close()
+		r.Reconnect()
+		return nil, conn.Err()
+	}
+
+	keys := []string{}
+	seen := make(map[string]bool)
+	cursor := "0"
+	for {
+		reply, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", pattern, "COUNT", "1000"))
+		if err != nil {
+			return nil, err
+		}
+
+		if len(reply) != 2 {
+			return nil, fmt.Errorf("unexpected SCAN reply of length %d", len(reply))
+		}
+
+		cursor, err = redis.String(reply[0], nil)
+		if err != nil {
+			return nil, err
+		}
+
+		batch, err := redis.Strings(reply[1], nil)
+		if err != nil {
+			return nil, err
+		}
+
+		// SCAN may return a key more than once
+		for _, k := range batch {
+			if !seen[k] {
+				seen[k] = true
+				keys = append(keys, k)
+			}
+		}
+
+		if cursor == "0" {
+			return keys, nil
+		}
+	}
+}
+
 func (r *RedisBackend) Keys(key string) ([]string, error) {
 	conn := r.redisPool.Get()
 	defer conn.Close()
@@ -545,13 +865,7 @@ func (r *RedisBackend) GetAll(key string) (map[string]string, error) {
 		return nil, err
 	}
 
-	serialized := make(map[string]string)
-	for i := 0; i < len(matches); i += 2 {
-		key := string(matches[i].([]byte))
-		value := string(matches[i+1].([]byte))
-		serialized[key] = value
-	}
-	return serialized, nil
+	return utils.HashValues(key, matches)
 
 }
 
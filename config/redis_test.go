@@ -1,9 +1,11 @@
 package config
 
 import (
+	"errors"
 	"fmt"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/garyburd/redigo/redis"
 )
@@ -109,3 +111,375 @@ func assertInHistory(t *testing.T, history []string, cmd string) {
 		t.Fatalf("Expected %s in [%s]", cmd, strings.Join(history, ","))
 	}
 }
+
+// hashConn returns a TestConn DoFn that stores hashes written with HMSET and
+// returns them from HGETALL.
+func hashConn(hashes map[string]map[string]string) func(string, ...interface{}) (interface{}, error) {
+	return func(cmd string, args ...interface{}) (interface{}, error) {
+		switch cmd {
+		case "HMSET":
+			key := args[0].(string)
+			if hashes[key] == nil {
+				hashes[key] = make(map[string]string)
+			}
+			for i := 1; i < len(args); i += 2 {
+				hashes[key][args[i].(string)] = args[i+1].(string)
+			}
+			return "OK", nil
+		case "HGETALL":
+			reply := []interface{}{}
+			for k, v := range hashes[args[0].(string)] {
+				reply = append(reply, []byte(k), []byte(v))
+			}
+			return reply, nil
+		}
+		return nil, nil
+	}
+}
+
+func setEnvKeys(t *testing.T, r *RedisBackend, keys [][]byte) {
+	c, err := newEnvCipher(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.envCipher = c
+}
+
+func TestEnvEncryptedAtRest(t *testing.T) {
+	keys, err := ParseEnvKeys("MDEyMzQ1Njc4OWFiY2RlZg==")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hashes := make(map[string]map[string]string)
+	r, c := NewTestRedisBackend()
+	setEnvKeys(t, r, keys)
+	c.DoFn = hashConn(hashes)
+
+	app := NewAppConfigWithEnv("foo", "", map[string]string{"PASSWORD": "secret"})
+	if _, err := r.UpdateApp(app, "dev"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, v := range hashes["dev/foo/environment"] {
+		if !strings.HasPrefix(v, encryptedPrefix) {
+			t.Fatalf("Expected encrypted value, got %q", v)
+		}
+	}
+
+	app, err = r.GetApp("foo", "dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if app.EnvGet("PASSWORD") != "secret" {
+		t.Fatalf("EnvGet(%q) = %q, want %q", "PASSWORD", app.EnvGet("PASSWORD"), "secret")
+	}
+
+	r.envCipher = nil
+	if _, err := r.GetApp("foo", "dev"); err == nil {
+		t.Fatal("Expected an error reading encrypted env without a key")
+	}
+}
+
+func TestEnvPlaintextReadableWithKey(t *testing.T) {
+	keys, err := ParseEnvKeys("MDEyMzQ1Njc4OWFiY2RlZg==")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hashes := make(map[string]map[string]string)
+	r, c := NewTestRedisBackend()
+	c.DoFn = hashConn(hashes)
+
+	app := NewAppConfigWithEnv("foo", "", map[string]string{"PASSWORD": "secret"})
+	if _, err := r.UpdateApp(app, "dev"); err != nil {
+		t.Fatal(err)
+	}
+
+	setEnvKeys(t, r, keys)
+	app, err = r.GetApp("foo", "dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if app.EnvGet("PASSWORD") != "secret" {
+		t.Fatalf("EnvGet(%q) = %q, want %q", "PASSWORD", app.EnvGet("PASSWORD"), "secret")
+	}
+}
+
+func TestEnvKeyRotation(t *testing.T) {
+	oldKeys, _ := ParseEnvKeys("MDEyMzQ1Njc4OWFiY2RlZg==")
+	newKeys, _ := ParseEnvKeys("ZmVkY2JhOTg3NjU0MzIxMA==,MDEyMzQ1Njc4OWFiY2RlZg==")
+
+	hashes := make(map[string]map[string]string)
+	r, c := NewTestRedisBackend()
+	setEnvKeys(t, r, oldKeys)
+	c.DoFn = hashConn(hashes)
+
+	app := NewAppConfigWithEnv("foo", "", map[string]string{"PASSWORD": "secret"})
+	if _, err := r.UpdateApp(app, "dev"); err != nil {
+		t.Fatal(err)
+	}
+
+	setEnvKeys(t, r, newKeys)
+	app, err := r.GetApp("foo", "dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if app.EnvGet("PASSWORD") != "secret" {
+		t.Fatalf("EnvGet(%q) = %q, want %q", "PASSWORD", app.EnvGet("PASSWORD"), "secret")
+	}
+
+	// saving re-encrypts with the new key, so the old one can be dropped
+	if _, err := r.UpdateApp(app, "dev"); err != nil {
+		t.Fatal(err)
+	}
+
+	setEnvKeys(t, r, newKeys[:1])
+	app, err = r.GetApp("foo", "dev")
+	if err != nil {
+		t.Fatalf("GetApp() with only the new key: %s", err)
+	}
+
+	if app.EnvGet("PASSWORD") != "secret" {
+		t.Fatalf("EnvGet(%q) = %q, want %q", "PASSWORD", app.EnvGet("PASSWORD"), "secret")
+	}
+}
+
+func TestEnvSaveWritesNewFields(t *testing.T) {
+	keys, _ := ParseEnvKeys("MDEyMzQ1Njc4OWFiY2RlZg==")
+
+	hashes := make(map[string]map[string]string)
+	r, c := NewTestRedisBackend()
+	setEnvKeys(t, r, keys)
+	c.DoFn = hashConn(hashes)
+
+	app := NewAppConfigWithEnv("foo", "", map[string]string{"PASSWORD": "secret"})
+	if _, err := r.UpdateApp(app, "dev"); err != nil {
+		t.Fatal(err)
+	}
+
+	c.History = nil
+	app.EnvSet("USER", "admin")
+	if _, err := r.UpdateApp(app, "dev"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, cmd := range c.History {
+		if strings.HasPrefix(cmd, "HMSET dev/foo/environment ") {
+			// the key and one field and value
+			if n := len(strings.Fields(cmd)); n != 4 {
+				t.Fatalf("Expected only the new field written, got %q", cmd)
+			}
+			if !strings.Contains(cmd, "USER:") {
+				t.Fatalf("Expected the USER field written, got %q", cmd)
+			}
+			return
+		}
+	}
+	t.Fatalf("Expected HMSET dev/foo/environment in [%s]", strings.Join(c.History, ","))
+}
+
+func TestListAppsSkipsCorruptApp(t *testing.T) {
+	hashes := make(map[string]map[string]string)
+	r, c := NewTestRedisBackend()
+	hashDo := hashConn(hashes)
+	c.DoFn = func(cmd string, args ...interface{}) (interface{}, error) {
+		if cmd != "SCAN" {
+			return hashDo(cmd, args...)
+		}
+
+		keys := []interface{}{}
+		for k := range hashes {
+			if strings.HasSuffix(k, "/version") {
+				keys = append(keys, []byte(k))
+			}
+		}
+		return []interface{}{[]byte("0"), keys}, nil
+	}
+
+	for _, app := range []string{"good", "bad", "other"} {
+		if _, err := r.UpdateApp(NewAppConfig(app, app+":v1"), "dev"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hashes["dev/bad/version"]["corrupt"] = "1"
+
+	apps, err := r.ListApps("dev")
+	if err != nil {
+		t.Fatalf("ListApps() error = %v, want the healthy apps", err)
+	}
+
+	if len(apps) != 2 {
+		t.Fatalf("ListApps() = %d apps, want %d", len(apps), 2)
+	}
+
+	for _, svcCfg := range apps {
+		if svcCfg.Name == "bad" {
+			t.Errorf("ListApps() returned the corrupt app")
+		}
+	}
+}
+
+func TestParseEnvKeysInvalid(t *testing.T) {
+	for _, s := range []string{"not-base64!", "c2hvcnQ="} {
+		if _, err := ParseEnvKeys(s); err == nil {
+			t.Errorf("ParseEnvKeys(%q) should have returned an error", s)
+		}
+	}
+}
+
+func TestLockAppKeyFormat(t *testing.T) {
+	r, c := NewTestRedisBackend()
+	c.DoFn = func(cmd string, args ...interface{}) (interface{}, error) {
+		return "OK", nil
+	}
+
+	_, err := r.LockApp("foo", "dev", 30*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := false
+	for _, cmd := range c.History {
+		if strings.HasPrefix(cmd, "SET dev/locks/foo ") && strings.HasSuffix(cmd, " NX PX 30000") {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("Expected SET NX PX on dev/locks/foo in [%s]", strings.Join(c.History, ","))
+	}
+}
+
+func TestLockAppHeld(t *testing.T) {
+	r, _ := NewTestRedisBackend()
+
+	// SET NX replies nil when the key exists
+	if _, err := r.LockApp("foo", "dev", 30*time.Second); err != ErrAppLocked {
+		t.Fatalf("LockApp() = %v, want %v", err, ErrAppLocked)
+	}
+}
+
+func TestAppHistoryKeyFormat(t *testing.T) {
+	r, c := NewTestRedisBackend()
+	keys, _ := ParseEnvKeys("MDEyMzQ1Njc4OWFiY2RlZg==")
+	setEnvKeys(t, r, keys)
+
+	var pushed string
+	c.SendFn = func(cmd string, args ...interface{}) error {
+		if cmd == "LPUSH" {
+			pushed = args[1].(string)
+		}
+		return nil
+	}
+	c.DoFn = hashConn(make(map[string]map[string]string))
+
+	app := NewAppConfigWithEnv("foo", "foo:v1", map[string]string{"PASSWORD": "secret"})
+	if _, err := r.UpdateApp(app, "dev"); err != nil {
+		t.Fatal(err)
+	}
+
+	assertInHistory(t, c.History, "LTRIM dev/foo/history 0 19")
+
+	if !strings.HasPrefix(pushed, encryptedPrefix) {
+		t.Fatalf("Expected encrypted history entry, got %q", pushed)
+	}
+}
+
+func TestListEnvsScan(t *testing.T) {
+	r, c := NewTestRedisBackend()
+
+	pages := map[string][]interface{}{
+		"0": {[]byte("7"), []interface{}{[]byte("dev/foo/environment"), []byte("prod/foo/environment")}},
+		"7": {[]byte("0"), []interface{}{[]byte("dev/foo/environment"), []byte("dev/bar/environment")}},
+	}
+	c.DoFn = func(cmd string, args ...interface{}) (interface{}, error) {
+		if cmd != "SCAN" {
+			return nil, nil
+		}
+		return pages[args[0].(string)], nil
+	}
+
+	envs, err := r.ListEnvs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertInHistory(t, c.History, "SCAN 7 MATCH */*/environment COUNT 1000")
+
+	if len(envs) != 2 || envs[0] != "dev" || envs[1] != "prod" {
+		t.Fatalf("ListEnvs() = %v, want [dev prod]", envs)
+	}
+}
+
+func TestGcVMapErrorReturned(t *testing.T) {
+	r, c := NewTestRedisBackend()
+	c.DoFn = func(cmd string, args ...interface{}) (interface{}, error) {
+		switch cmd {
+		case "HMSET":
+			return "OK", nil
+		case "HDEL":
+			return nil, errors.New("connection reset")
+		}
+		return nil, nil
+	}
+
+	app := NewAppConfig("foo", "")
+	for i := 0; i < 10; i++ {
+		app.SetVersion(fmt.Sprintf("foo:v%d", i))
+	}
+
+	if _, err := r.UpdateApp(app, "dev"); err == nil {
+		t.Fatal("UpdateApp() should have returned the HDEL error")
+	}
+}
+
+func TestGetAppConnError(t *testing.T) {
+	r, c := NewTestRedisBackend()
+	c.ErrFn = func() error {
+		return errors.New("connection refused")
+	}
+
+	if _, err := r.GetApp("foo", "dev"); err == nil {
+		t.Fatal("GetApp() should have returned the connection error")
+	}
+}
+
+func TestGetAllNilValue(t *testing.T) {
+	r, c := NewTestRedisBackend()
+	c.DoFn = func(cmd string, args ...interface{}) (interface{}, error) {
+		return []interface{}{[]byte("id"), []byte("1"), []byte("version"), nil}, nil
+	}
+
+	values, err := r.GetAll("dev/foo/environment")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(values) != 1 || values["id"] != "1" {
+		t.Errorf("GetAll() = %v, want map[id:1]", values)
+	}
+
+	c.DoFn = func(cmd string, args ...interface{}) (interface{}, error) {
+		return []interface{}{[]byte("id"), int64(1)}, nil
+	}
+
+	if _, err := r.GetAll("dev/foo/environment"); err == nil {
+		t.Error("GetAll() should fail on a malformed reply")
+	}
+}
+
+func TestAuditKeyFormat(t *testing.T) {
+	r, c := NewTestRedisBackend()
+
+	r.AddAuditEntry("dev", "", &AuditEntry{Action: "create app", Target: "foo"})
+	assertInHistory(t, c.History, "LTRIM dev/audit 0 999")
+
+	r.ListAuditEntries("dev", "", 10)
+	assertInHistory(t, c.History, "LRANGE dev/audit 0 9")
+
+	r.AddAuditEntry("dev", RegistryAuditLog, &AuditEntry{Action: "register", Target: "foo"})
+	assertInHistory(t, c.History, "LTRIM dev/audit/registry 0 999")
+}
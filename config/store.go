@@ -4,7 +4,10 @@ import (
 	"errors"
 	"fmt"
 	"net/url"
+	"path"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/litl/galaxy/log"
 	"github.com/litl/galaxy/utils"
@@ -21,8 +24,22 @@ TODO: IMPORTANT: make an atomic compare-and-swap script to save configs, or
 
 const (
 	DefaultTTL = 60
+
+	// DefaultPollInterval is how often Watch checks for config changes it
+	// may have missed notifications for.
+	DefaultPollInterval = 10 * time.Second
+
+	rollbackLockTTL = 30 * time.Second
 )
 
+// reservedAppNames are keys kept alongside apps under an env, which apps
+// can't be named.
+var reservedAppNames = []string{"hosts", "pools", "locks", "audit"}
+
+// ErrReservedName is returned when an app would be named after one of the
+// keys kept under an env.
+var ErrReservedName = errors.New("app name is reserved")
+
 type HostInfo struct {
 	HostIP string
 }
@@ -34,6 +51,26 @@ type Store struct {
 	OutputBuffer *utils.OutputBuffer
 	pollCh       chan bool
 	registryURL  string
+
+	// PollInterval overrides DefaultPollInterval for Watch.
+	PollInterval time.Duration
+
+	// EnvKeys are passed to the redis backend to encrypt app environments.
+	// See ParseEnvKeys.
+	EnvKeys [][]byte
+
+	// Actor identifies who is making changes in audit entries.
+	Actor string
+
+	// StaleReads has GetApp and ListApps return the last config read, for
+	// up to MaxStale, when redis can't be reached rather than failing.
+	// Such configs are marked with StaleSince.
+	StaleReads bool
+
+	// MaxStale overrides DefaultMaxStale.
+	MaxStale time.Duration
+
+	cache appCache
 }
 
 func NewStore(ttl uint64) *Store {
@@ -54,8 +91,14 @@ func (r *Store) Connect(registryURL string) {
 	}
 
 	if strings.ToLower(u.Scheme) == "redis" {
+		c, err := newEnvCipher(r.EnvKeys)
+		if err != nil {
+			log.Fatalf("ERROR: Invalid env keys: %s", err)
+		}
+
 		r.Backend = &RedisBackend{
 			RedisHost: u.Host,
+			envCipher: c,
 		}
 		r.Backend.Connect()
 	} else {
@@ -110,6 +153,10 @@ func (r *Store) AssignApp(app, env, pool string) (bool, error) {
 		return false, err
 	}
 
+	if added {
+		r.Audit(env, "assign app", path.Join(pool, app))
+	}
+
 	err = r.NotifyRestart(app, env)
 	if err != nil {
 		return added, err
@@ -123,6 +170,7 @@ func (r *Store) UnassignApp(app, env, pool string) (bool, error) {
 	if !removed || err != nil {
 		return removed, err
 	}
+	r.Audit(env, "unassign app", path.Join(pool, app))
 
 	err = r.NotifyRestart(app, env)
 	if err != nil {
@@ -133,7 +181,11 @@ func (r *Store) UnassignApp(app, env, pool string) (bool, error) {
 }
 
 func (r *Store) CreatePool(name, env string) (bool, error) {
-	return r.Backend.CreatePool(env, name)
+	created, err := r.Backend.CreatePool(env, name)
+	if created && err == nil {
+		r.Audit(env, "create pool", name)
+	}
+	return created, err
 }
 
 func (r *Store) DeletePool(pool, env string) (bool, error) {
@@ -146,7 +198,11 @@ func (r *Store) DeletePool(pool, env string) (bool, error) {
 		return false, nil
 	}
 
-	return r.Backend.DeletePool(pool, env)
+	deleted, err := r.Backend.DeletePool(pool, env)
+	if deleted && err == nil {
+		r.Audit(env, "delete pool", pool)
+	}
+	return deleted, err
 }
 
 func (r *Store) ListPools(env string) ([]string, error) {
@@ -154,15 +210,26 @@ func (r *Store) ListPools(env string) ([]string, error) {
 }
 
 func (r *Store) CreateApp(app, env string) (bool, error) {
+	if utils.StringInSlice(app, reservedAppNames) {
+		return false, ErrReservedName
+	}
+
 	if exists, err := r.AppExists(app, env); exists || err != nil {
 		return false, err
 	}
 
-	return r.Backend.CreateApp(app, env)
-
+	created, err := r.Backend.CreateApp(app, env)
+	r.cache.invalidate(env)
+	if created && err == nil {
+		r.Audit(env, "create app", app)
+	}
+	return created, err
 }
 
 func (r *Store) DeleteApp(app, env string) (bool, error) {
+	if utils.StringInSlice(app, reservedAppNames) {
+		return false, ErrReservedName
+	}
 
 	pools, err := r.ListPools(env)
 	if err != nil {
@@ -189,9 +256,11 @@ func (r *Store) DeleteApp(app, env string) (bool, error) {
 	}
 
 	deleted, err := r.Backend.DeleteApp(svcCfg, env)
+	r.cache.invalidate(env, app)
 	if !deleted || err != nil {
 		return deleted, err
 	}
+	r.Audit(env, "delete app", app)
 
 	err = r.NotifyEnvChanged(env)
 	if err != nil {
@@ -201,32 +270,194 @@ func (r *Store) DeleteApp(app, env string) (bool, error) {
 	return true, nil
 }
 
-func (r *Store) ListApps(env string) ([]*AppConfig, error) {
-	return r.Backend.ListApps(env)
+// DeleteErrors holds the failures of a bulk delete, by app.
+type DeleteErrors map[string]error
+
+func (e DeleteErrors) Error() string {
+	apps := []string{}
+	for app := range e {
+		apps = append(apps, app)
+	}
+	sort.Strings(apps)
+
+	msgs := []string{}
+	for _, app := range apps {
+		msgs = append(msgs, fmt.Sprintf("%s: %s", app, e[app]))
+	}
+	return strings.Join(msgs, "; ")
 }
 
-func (r *Store) ListEnvs() ([]string, error) {
-	return r.Backend.ListEnvs()
+// DeleteApps deletes several apps from env, notifying agents once.  As with
+// DeleteApp, apps still assigned to a pool are not deleted.  It returns the
+// number of apps deleted, and a DeleteErrors for any that failed.
+func (r *Store) DeleteApps(env string, apps ...string) (int, error) {
+	pools, err := r.ListPools(env)
+	if err != nil {
+		return 0, err
+	}
+
+	assigned := make(map[string]string)
+	for _, pool := range pools {
+		assignments, err := r.ListAssignments(env, pool)
+		if err != nil {
+			return 0, err
+		}
+		for _, app := range assignments {
+			assigned[app] = pool
+		}
+	}
+
+	count := 0
+	errs := DeleteErrors{}
+	for _, app := range apps {
+		if utils.StringInSlice(app, reservedAppNames) {
+			errs[app] = ErrReservedName
+			continue
+		}
+
+		if pool, ok := assigned[app]; ok {
+			errs[app] = fmt.Errorf("app is assigned to pool %s", pool)
+			continue
+		}
+
+		svcCfg, err := r.Backend.GetApp(app, env)
+		if err != nil {
+			errs[app] = err
+			continue
+		}
+
+		if svcCfg == nil {
+			continue
+		}
+
+		deleted, err := r.Backend.DeleteApp(svcCfg, env)
+		r.cache.invalidate(env, app)
+		if err != nil {
+			errs[app] = err
+			continue
+		}
+
+		if deleted {
+			r.Audit(env, "delete app", app)
+			count++
+		}
+	}
+
+	if count > 0 {
+		if err := r.NotifyEnvChanged(env); err != nil {
+			return count, err
+		}
+	}
+
+	if len(errs) > 0 {
+		return count, errs
+	}
+	return count, nil
 }
 
-func (r *Store) GetApp(app, env string) (*AppConfig, error) {
-	exists, err := r.AppExists(app, env)
+// DeletePoolApps unassigns every app from pool at once, and deletes the ones
+// that aren't assigned to any other pool.  Apps in other pools are left alone.
+// It returns the apps unassigned and the number deleted.  Once the apps are
+// unassigned both are returned even with an error, as DeleteApps does, since
+// the pool has already been cleared.
+func (r *Store) DeletePoolApps(env, pool string) ([]string, int, error) {
+	if env == "" || pool == "" {
+		return nil, 0, errors.New("env and pool are required")
+	}
+
+	exists, err := r.PoolExists(env, pool)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
 	if !exists {
-		return nil, fmt.Errorf("app %s does not exist", app)
+		return nil, 0, fmt.Errorf("pool %s does not exist", pool)
 	}
 
-	return r.Backend.GetApp(app, env)
+	apps, err := r.ListAssignments(env, pool)
+	if err != nil || len(apps) == 0 {
+		return nil, 0, err
+	}
+
+	if _, err := r.Backend.UnassignApps(env, pool, apps...); err != nil {
+		return nil, 0, err
+	}
+
+	for _, app := range apps {
+		r.Audit(env, "unassign app", path.Join(pool, app))
+		if err := r.NotifyRestart(app, env); err != nil {
+			return apps, 0, err
+		}
+	}
+
+	pools, err := r.ListPools(env)
+	if err != nil {
+		return apps, 0, err
+	}
+
+	assigned := make(map[string]bool)
+	for _, p := range pools {
+		assignments, err := r.ListAssignments(env, p)
+		if err != nil {
+			return apps, 0, err
+		}
+		for _, app := range assignments {
+			assigned[app] = true
+		}
+	}
+
+	orphans := []string{}
+	for _, app := range apps {
+		if !assigned[app] {
+			orphans = append(orphans, app)
+		}
+	}
+
+	deleted, err := r.DeleteApps(env, orphans...)
+	return apps, deleted, err
+}
+
+func (r *Store) ListApps(env string) ([]*AppConfig, error) {
+	return r.readThrough(env, func() ([]*AppConfig, error) {
+		return r.Backend.ListApps(env)
+	})
+}
+
+func (r *Store) ListEnvs() ([]string, error) {
+	return r.Backend.ListEnvs()
+}
+
+func (r *Store) GetApp(app, env string) (*AppConfig, error) {
+	apps, err := r.readThrough(path.Join(env, app), func() ([]*AppConfig, error) {
+		exists, err := r.AppExists(app, env)
+		if err != nil {
+			return nil, err
+		}
+
+		if !exists {
+			return nil, fmt.Errorf("app %s does not exist", app)
+		}
+
+		svcCfg, err := r.Backend.GetApp(app, env)
+		if err != nil || svcCfg == nil {
+			return nil, err
+		}
+		return []*AppConfig{svcCfg}, nil
+	})
+
+	if err != nil || len(apps) == 0 {
+		return nil, err
+	}
+	return apps[0], nil
 }
 
 func (r *Store) UpdateApp(svcCfg *AppConfig, env string) (bool, error) {
 	updated, err := r.Backend.UpdateApp(svcCfg, env)
+	r.cache.invalidate(env, svcCfg.Name)
 	if !updated || err != nil {
 		return updated, err
 	}
+	r.Audit(env, "update app", fmt.Sprintf("%s@%d", svcCfg.Name, svcCfg.ID()))
 
 	err = r.NotifyEnvChanged(env)
 	if err != nil {
@@ -235,6 +466,54 @@ func (r *Store) UpdateApp(svcCfg *AppConfig, env string) (bool, error) {
 	return true, nil
 }
 
+// ListAppVersions returns the last HistorySize configs written for app,
+// newest first.
+func (r *Store) ListAppVersions(app, env string) ([]*AppVersion, error) {
+	return r.Backend.ListAppVersions(app, env)
+}
+
+// RollbackApp restores the config of app saved with the given id.  The restore
+// is written as a new change while holding the app's deploy lock, so it can't
+// interleave with a concurrent deploy.
+func (r *Store) RollbackApp(app, env string, id int64) (bool, error) {
+	unlock, err := r.LockApp(app, env, rollbackLockTTL)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	versions, err := r.ListAppVersions(app, env)
+	if err != nil {
+		return false, err
+	}
+
+	var target *AppVersion
+	for _, v := range versions {
+		if v.ID == id {
+			target = v
+			break
+		}
+	}
+
+	if target == nil {
+		return false, fmt.Errorf("app %s has no saved version %d", app, id)
+	}
+
+	svcCfg, err := r.GetApp(app, env)
+	if err != nil {
+		return false, err
+	}
+
+	target.Restore(svcCfg)
+	return r.UpdateApp(svcCfg, env)
+}
+
+// LockApp takes an advisory lock on app so concurrent deploys don't interleave
+// their writes.  The lock expires after ttl in case the holder dies.
+func (r *Store) LockApp(app, env string, ttl time.Duration) (func() error, error) {
+	return r.Backend.LockApp(app, env, ttl)
+}
+
 func (r *Store) UpdateHost(env, pool string, host HostInfo) error {
 	return r.Backend.UpdateHost(env, pool, host)
 }
@@ -2,7 +2,9 @@ package config
 
 import (
 	"errors"
+	"net"
 	"testing"
+	"time"
 )
 
 func NewTestStore() (*Store, *MemoryBackend) {
@@ -399,3 +401,435 @@ func assertPoolCreated(t *testing.T, r *Store, pool string) {
 		t.Errorf("CreatePool(%q) = %t, %v, want %t, %v", pool, created, err, true, nil)
 	}
 }
+
+func TestLockApp(t *testing.T) {
+	r, _ := NewTestStore()
+
+	unlock, err := r.LockApp("app", "dev", time.Minute)
+	if err != nil {
+		t.Fatalf("LockApp(%q) = %v, want %v", "app", err, nil)
+	}
+
+	if _, err := r.LockApp("app", "dev", time.Minute); err != ErrAppLocked {
+		t.Fatalf("LockApp(%q) = %v, want %v", "app", err, ErrAppLocked)
+	}
+
+	if _, err := r.LockApp("other", "dev", time.Minute); err != nil {
+		t.Fatalf("LockApp(%q) = %v, want %v", "other", err, nil)
+	}
+
+	if err := unlock(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := r.LockApp("app", "dev", time.Minute); err != nil {
+		t.Fatalf("LockApp(%q) after unlock = %v, want %v", "app", err, nil)
+	}
+}
+
+func TestLockAppConcurrent(t *testing.T) {
+	r, _ := NewTestStore()
+
+	results := make(chan error)
+	for i := 0; i < 20; i++ {
+		go func() {
+			_, err := r.LockApp("app", "dev", time.Minute)
+			results <- err
+		}()
+	}
+
+	locked := 0
+	for i := 0; i < 20; i++ {
+		if err := <-results; err == nil {
+			locked++
+		}
+	}
+
+	if locked != 1 {
+		t.Errorf("%d concurrent LockApp() calls succeeded, want %d", locked, 1)
+	}
+}
+
+func TestRollbackApp(t *testing.T) {
+	r, _ := NewTestStore()
+	assertAppCreated(t, r, "app")
+
+	svcCfg, err := r.GetApp("app", "dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	svcCfg.SetVersion("app:v1")
+	if _, err := r.UpdateApp(svcCfg, "dev"); err != nil {
+		t.Fatal(err)
+	}
+
+	svcCfg.SetVersion("app:v2")
+	svcCfg.EnvSet("DEBUG", "1")
+	if _, err := r.UpdateApp(svcCfg, "dev"); err != nil {
+		t.Fatal(err)
+	}
+
+	versions, err := r.ListAppVersions("app", "dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(versions) != 2 || versions[0].Version != "app:v2" {
+		t.Fatalf("ListAppVersions() = %v, want app:v2 first of 2", versions)
+	}
+
+	if _, err := r.RollbackApp("app", "dev", versions[1].ID); err != nil {
+		t.Fatal(err)
+	}
+
+	svcCfg, err = r.GetApp("app", "dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if svcCfg.Version() != "app:v1" {
+		t.Errorf("Version() = %q, want %q", svcCfg.Version(), "app:v1")
+	}
+
+	if svcCfg.EnvGet("DEBUG") != "" {
+		t.Errorf("EnvGet(%q) = %q, want %q", "DEBUG", svcCfg.EnvGet("DEBUG"), "")
+	}
+
+	versions, _ = r.ListAppVersions("app", "dev")
+	if len(versions) != 3 {
+		t.Errorf("len(ListAppVersions()) = %d, want %d", len(versions), 3)
+	}
+
+	if _, err := r.RollbackApp("app", "dev", 12345); err == nil {
+		t.Error("RollbackApp() to an unknown version should have returned an error")
+	}
+}
+
+func TestWatchSeesEveryChange(t *testing.T) {
+	r, _ := NewTestStore()
+	r.pollCh = make(chan bool)
+	r.PollInterval = 10 * time.Millisecond
+	assertAppCreated(t, r, "app")
+
+	stop := make(chan struct{})
+	defer close(stop)
+	changes := r.Watch("dev", stop)
+
+	// returns once the initial versions have been recorded
+	r.CheckForChangesNow()
+
+	for _, version := range []string{"app:v1", "app:v2"} {
+		svcCfg, err := r.GetApp("app", "dev")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the memory backend returns the config the watcher reads
+		svcCfg = copyAppConfig(svcCfg)
+		svcCfg.SetVersion(version)
+		if _, err := r.UpdateApp(svcCfg, "dev"); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case change := <-changes:
+			if change.Error != nil {
+				t.Fatal(change.Error)
+			}
+			if change.AppConfig.Version() != version {
+				t.Errorf("Version() = %q, want %q", change.AppConfig.Version(), version)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for %s", version)
+		}
+	}
+}
+
+func TestDeleteApps(t *testing.T) {
+	r, _ := NewTestStore()
+
+	assertPoolCreated(t, r, "web")
+	for _, app := range []string{"one", "two", "three"} {
+		assertAppCreated(t, r, app)
+	}
+	r.AssignApp("three", "dev", "web")
+
+	deleted, err := r.DeleteApps("dev", "one", "two", "three", "missing")
+	if deleted != 2 {
+		t.Errorf("DeleteApps() = %d, want %d", deleted, 2)
+	}
+
+	errs, ok := err.(DeleteErrors)
+	if !ok || len(errs) != 1 || errs["three"] == nil {
+		t.Fatalf("DeleteApps() error = %v, want one for the assigned app", err)
+	}
+
+	for _, app := range []string{"one", "two"} {
+		if exists, _ := r.AppExists(app, "dev"); exists {
+			t.Errorf("%s still exists after DeleteApps()", app)
+		}
+	}
+	assertAppExists(t, r, "three")
+}
+
+func TestDeletePoolApps(t *testing.T) {
+	r, _ := NewTestStore()
+
+	assertPoolCreated(t, r, "web")
+	assertPoolCreated(t, r, "worker")
+	for _, app := range []string{"site", "api", "jobs"} {
+		assertAppCreated(t, r, app)
+	}
+	r.AssignApp("site", "dev", "web")
+	r.AssignApp("api", "dev", "web")
+	r.AssignApp("api", "dev", "worker")
+	r.AssignApp("jobs", "dev", "worker")
+
+	apps, deleted, err := r.DeletePoolApps("dev", "web")
+	if len(apps) != 2 || deleted != 1 || err != nil {
+		t.Fatalf("DeletePoolApps() = %v, %d, %v, want site and api, %d, %v", apps, deleted, err, 1, nil)
+	}
+
+	if exists, _ := r.AppExists("site", "dev"); exists {
+		t.Errorf("site still exists after DeletePoolApps()")
+	}
+	assertAppExists(t, r, "api")
+	assertAppExists(t, r, "jobs")
+
+	if apps, _ := r.ListAssignments("dev", "web"); len(apps) != 0 {
+		t.Errorf("ListAssignments(%q) = %v, want none", "web", apps)
+	}
+
+	if apps, _ := r.ListAssignments("dev", "worker"); len(apps) != 2 {
+		t.Errorf("ListAssignments(%q) = %v, want api and jobs", "worker", apps)
+	}
+
+	if _, _, err := r.DeletePoolApps("dev", ""); err == nil {
+		t.Error("DeletePoolApps() should require a pool")
+	}
+}
+
+func TestDeletePoolAppsPartial(t *testing.T) {
+	r, b := NewTestStore()
+
+	assertPoolCreated(t, r, "web")
+	for _, app := range []string{"one", "two", "three"} {
+		assertAppCreated(t, r, app)
+		r.AssignApp(app, "dev", "web")
+	}
+
+	b.DeleteAppFunc = func(svcCfg *AppConfig, env string) (bool, error) {
+		if svcCfg.Name == "two" {
+			return false, errors.New("connection refused")
+		}
+		return true, nil
+	}
+
+	apps, deleted, err := r.DeletePoolApps("dev", "web")
+	if len(apps) != 3 || deleted != 2 {
+		t.Errorf("DeletePoolApps() = %v, %d, want all 3 apps unassigned and 2 deleted", apps, deleted)
+	}
+
+	errs, ok := err.(DeleteErrors)
+	if !ok || len(errs) != 1 || errs["two"] == nil {
+		t.Fatalf("DeletePoolApps() error = %v, want one for the failed delete", err)
+	}
+
+	if assigned, _ := r.ListAssignments("dev", "web"); len(assigned) != 0 {
+		t.Errorf("ListAssignments(%q) = %v, want none", "web", assigned)
+	}
+}
+
+func TestAuditEntries(t *testing.T) {
+	r, _ := NewTestStore()
+	r.Actor = "alice@laptop"
+
+	assertPoolCreated(t, r, "web")
+	assertAppCreated(t, r, "app")
+	r.AssignApp("app", "dev", "web")
+
+	entries, err := r.ListAuditEntries("dev", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 3 {
+		t.Fatalf("ListAuditEntries() = %d entries, want %d", len(entries), 3)
+	}
+
+	if e := entries[0]; e.Action != "assign app" || e.Target != "web/app" || e.Actor != "alice@laptop" {
+		t.Errorf("newest entry = %+v, want app assigned to web by alice@laptop", e)
+	}
+
+	if entries, _ := r.ListAuditEntries("dev", "", 1); len(entries) != 1 {
+		t.Errorf("ListAuditEntries(1) = %d entries, want %d", len(entries), 1)
+	}
+}
+
+func TestAuditConcurrent(t *testing.T) {
+	r, _ := NewTestStore()
+
+	done := make(chan bool)
+	for i := 0; i < 10; i++ {
+		go func() {
+			r.Audit("dev", "update app", "app")
+			r.ListAuditEntries("dev", "", 0)
+			done <- true
+		}()
+	}
+
+	for i := 0; i < 10; i++ {
+		<-done
+	}
+
+	if entries, _ := r.ListAuditEntries("dev", "", 0); len(entries) != 10 {
+		t.Errorf("ListAuditEntries() = %d entries, want %d", len(entries), 10)
+	}
+}
+
+func TestAuditRegistry(t *testing.T) {
+	r, _ := NewTestStore()
+
+	assertAppCreated(t, r, "app")
+	for i := 0; i < AuditSize; i++ {
+		r.AuditRegistry("dev", "register", "dev/web/hosts/10.0.0.1/app/1")
+	}
+
+	entries, _ := r.ListAuditEntries("dev", "", 0)
+	if len(entries) != 1 || entries[0].Action != "create app" {
+		t.Errorf("ListAuditEntries() = %d entries, want only the app's creation", len(entries))
+	}
+
+	entries, _ = r.ListAuditEntries("dev", RegistryAuditLog, 0)
+	if len(entries) != AuditSize {
+		t.Errorf("ListAuditEntries(%q) = %d entries, want %d", RegistryAuditLog, len(entries), AuditSize)
+	}
+}
+
+func TestAuditBestEffort(t *testing.T) {
+	r, b := NewTestStore()
+	b.AddAuditEntryFunc = func(env, auditLog string, entry *AuditEntry) error {
+		return errors.New("connection refused")
+	}
+
+	assertAppCreated(t, r, "app")
+}
+
+func TestGetAppStale(t *testing.T) {
+	r, b := NewTestStore()
+	r.StaleReads = true
+
+	assertAppCreated(t, r, "app")
+	if _, err := r.GetApp("app", "dev"); err != nil {
+		t.Fatal(err)
+	}
+
+	down := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	b.AppExistsFunc = func(app, env string) (bool, error) {
+		return false, down
+	}
+
+	svcCfg, err := r.GetApp("app", "dev")
+	if err != nil {
+		t.Fatalf("GetApp() error = %v, want the cached config", err)
+	}
+
+	if svcCfg.Name != "app" || svcCfg.StaleSince().IsZero() {
+		t.Errorf("GetApp() = %s stale since %s, want a stale app", svcCfg.Name, svcCfg.StaleSince())
+	}
+
+	if _, err := r.GetApp("other", "dev"); err != down {
+		t.Errorf("GetApp() of an uncached app error = %v, want %v", err, down)
+	}
+
+	stats := r.CacheStats()
+	if stats.Refreshes != 1 || stats.StaleServes != 1 || stats.Misses != 1 {
+		t.Errorf("CacheStats() = %+v, want 1 refresh, 1 stale serve and 1 miss", stats)
+	}
+
+	r.MaxStale = time.Nanosecond
+	time.Sleep(time.Millisecond)
+	if _, err := r.GetApp("app", "dev"); err != down {
+		t.Errorf("GetApp() past MaxStale error = %v, want %v", err, down)
+	}
+
+	// other errors aren't hidden
+	b.AppExistsFunc = func(app, env string) (bool, error) {
+		return false, errors.New("malformed app")
+	}
+	r.MaxStale = 0
+	if _, err := r.GetApp("app", "dev"); err == nil {
+		t.Error("GetApp() should return errors other than connection failures")
+	}
+}
+
+func TestWriteInvalidatesCache(t *testing.T) {
+	r, b := NewTestStore()
+	r.StaleReads = true
+
+	assertAppCreated(t, r, "app")
+	assertAppCreated(t, r, "other")
+	svcCfg, _ := r.GetApp("app", "dev")
+	r.ListApps("dev")
+
+	svcCfg.SetVersion("app:v2")
+	if _, err := r.UpdateApp(svcCfg, "dev"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := r.DeleteApp("other", "dev"); err != nil {
+		t.Fatal(err)
+	}
+
+	down := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	b.AppExistsFunc = func(app, env string) (bool, error) {
+		return false, down
+	}
+	b.ListAppsFunc = func(env string) ([]*AppConfig, error) {
+		return nil, down
+	}
+
+	if _, err := r.GetApp("app", "dev"); err != down {
+		t.Errorf("GetApp() after UpdateApp() error = %v, want %v rather than the old config", err, down)
+	}
+
+	if apps, err := r.ListApps("dev"); err != down {
+		t.Errorf("ListApps() after DeleteApp() = %d apps, %v, want %v rather than the old list", len(apps), err, down)
+	}
+}
+
+func TestListAppsStaleDisabled(t *testing.T) {
+	r, b := NewTestStore()
+
+	assertAppCreated(t, r, "app")
+	r.ListApps("dev")
+
+	b.ListAppsFunc = func(env string) ([]*AppConfig, error) {
+		return nil, &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	}
+
+	if _, err := r.ListApps("dev"); err == nil {
+		t.Error("ListApps() should fail without StaleReads")
+	}
+}
+
+func TestReservedAppNames(t *testing.T) {
+	r, _ := NewTestStore()
+
+	for _, app := range reservedAppNames {
+		if created, err := r.CreateApp(app, "dev"); created || err != ErrReservedName {
+			t.Errorf("CreateApp(%q) = %t, %v, want %t, %v", app, created, err, false, ErrReservedName)
+		}
+
+		if deleted, err := r.DeleteApp(app, "dev"); deleted || err != ErrReservedName {
+			t.Errorf("DeleteApp(%q) = %t, %v, want %t, %v", app, deleted, err, false, ErrReservedName)
+		}
+	}
+
+	count, err := r.DeleteApps("dev", "locks")
+	errs, ok := err.(DeleteErrors)
+	if count != 0 || !ok || errs["locks"] != ErrReservedName {
+		t.Errorf("DeleteApps(%q) = %d, %v, want %d, %v", "locks", count, err, 0, ErrReservedName)
+	}
+}
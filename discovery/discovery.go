@@ -1,6 +1,7 @@
 package discovery
 
 import (
+	"fmt"
 	"os"
 	"strings"
 	"time"
@@ -17,20 +18,32 @@ import (
 
 func Status(serviceRuntime *runtime.ServiceRuntime, serviceRegistry *registry.ServiceRegistry, env, pool, hostIP string) error {
 
+	if _, err := serviceRegistry.Ping(); err != nil {
+		return fmt.Errorf("cannot reach registry: %s", err)
+	}
+
 	containers, err := serviceRuntime.ManagedContainers()
 	if err != nil {
-		panic(err)
+		return err
+	}
+
+	registrations, err := serviceRegistry.ListHostRegistrations(env, pool, hostIP)
+	if err != nil {
+		return err
 	}
 
 	columns := []string{
-		"APP | CONTAINER ID | IMAGE | EXTERNAL | INTERNAL | PORT | CREATED | EXPIRES"}
+		"APP | CONTAINER ID | IMAGE | EXTERNAL | INTERNAL | PORT | CREATED | EXPIRES | LABELS"}
 
 	for _, container := range containers {
 		name := serviceRuntime.EnvFor(container)["GALAXY_APP"]
-		registered, err := serviceRegistry.GetServiceRegistration(
-			env, pool, hostIP, container)
-		if err != nil {
-			return err
+
+		var registered *registry.ServiceRegistration
+		for _, reg := range registrations[name] {
+			if reg.ContainerID == container.ID {
+				registered = reg
+				break
+			}
 		}
 
 		if registered != nil {
@@ -44,6 +57,7 @@ func Status(serviceRuntime *runtime.ServiceRuntime, serviceRegistry *registry.Se
 					registered.Port,
 					utils.HumanDuration(time.Now().UTC().Sub(registered.StartedAt)) + " ago",
 					"In " + utils.HumanDuration(registered.Expires.Sub(time.Now().UTC())),
+					registered.LabelString(),
 				}, " | "))
 
 		} else {
@@ -57,6 +71,7 @@ func Status(serviceRuntime *runtime.ServiceRuntime, serviceRegistry *registry.Se
 					"",
 					utils.HumanDuration(time.Now().Sub(container.Created)) + " ago",
 					"",
+					"",
 				}, " | "))
 		}
 
@@ -117,6 +132,19 @@ func Register(serviceRuntime *runtime.ServiceRuntime, serviceRegistry *registry.
 
 	RegisterAll(serviceRuntime, serviceRegistry, env, pool, hostIP, shuttleAddr, false)
 
+	go serviceRegistry.Reap(env, pool, hostIP, func() ([]string, error) {
+		containers, err := serviceRuntime.ManagedContainers()
+		if err != nil {
+			return nil, err
+		}
+
+		ids := []string{}
+		for _, c := range containers {
+			ids = append(ids, c.ID)
+		}
+		return ids, nil
+	}, nil)
+
 	containerEvents := make(chan runtime.ContainerEvent)
 	err := serviceRuntime.RegisterEvents(env, pool, hostIP, containerEvents)
 	if err != nil {
@@ -130,6 +158,14 @@ func Register(serviceRuntime *runtime.ServiceRuntime, serviceRegistry *registry.
 			switch ce.Status {
 			case "start":
 				reg, err := serviceRegistry.RegisterService(env, pool, hostIP, ce.Container)
+				if err == registry.ErrSuperseded {
+					log.Printf("Skipped registering %s: %s", ce.Container.ID[0:12], err)
+					continue
+				}
+				if err == registry.ErrNoPorts {
+					log.Printf("Container %s exposes no ports, not registering", ce.Container.ID[0:12])
+					continue
+				}
 				if err != nil {
 					log.Errorf("ERROR: Unable to register container: %s", err)
 					continue
@@ -156,6 +192,9 @@ func Register(serviceRuntime *runtime.ServiceRuntime, serviceRegistry *registry.
 		case <-time.After(10 * time.Second):
 			RegisterAll(serviceRuntime, serviceRegistry, env, pool, hostIP, shuttleAddr, true)
 			pruneShuttleBackends(configStore, serviceRegistry, env, shuttleAddr)
+			if err := serviceRegistry.PublishStats(hostIP); err != nil {
+				log.Errorf("ERROR: Unable to publish redis stats: %s", err)
+			}
 		}
 	}
 }
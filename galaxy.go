@@ -43,6 +43,12 @@ func init() {
 	tty = term.IsTerminal(os.Stdin.Fd())
 }
 
+// defaultActor names the local user and host for audit entries.
+func defaultActor() string {
+	hostname, _ := os.Hostname()
+	return os.Getenv("USER") + "@" + hostname
+}
+
 // ensure the registry as a redis host, but only once
 func initRegistry(c *cli.Context) {
 
@@ -61,6 +67,13 @@ func initStore(c *cli.Context) {
 		uint64(c.Int("ttl")),
 	)
 
+	envKeys, err := gconfig.ParseEnvKeys(os.Getenv("GALAXY_ENV_KEYS"))
+	if err != nil {
+		log.Fatalf("ERROR: Bad GALAXY_ENV_KEYS: %s", err)
+	}
+	configStore.EnvKeys = envKeys
+	configStore.Actor = utils.GetEnv("GALAXY_ACTOR", defaultActor())
+
 	configStore.Connect(utils.GalaxyRedisHost(c))
 }
 
@@ -529,6 +542,16 @@ func main() {
 		cli.StringFlag{Name: "registry", Value: "", Usage: "host:port[,host:port,..]"},
 		cli.StringFlag{Name: "env", Value: "", Usage: "environment (dev, test, prod, etc.)"},
 		cli.StringFlag{Name: "pool", Value: "", Usage: "pool (web, worker, etc.)"},
+		cli.StringFlag{Name: "log-level", Value: utils.GetEnv("GALAXY_LOG_LEVEL", "info"), Usage: "log level (debug, info, warn, error)"},
+	}
+
+	app.Before = func(c *cli.Context) error {
+		level, err := log.ParseLevel(c.GlobalString("log-level"))
+		if err != nil {
+			return err
+		}
+		log.SetLevel(level)
+		return nil
 	}
 
 	app.Commands = []cli.Command{
@@ -1,23 +1,54 @@
 package log
 
 import (
+	"fmt"
 	"io"
 	golog "log"
 	"os"
+	"strings"
+	"sync/atomic"
 
 	"github.com/fatih/color"
 )
 
+// Levels in increasing verbosity.  Print output is logged at INFO, and Fatal
+// and Panic output is never filtered.
 const (
 	ERROR = iota
-	INFO
 	WARN
+	INFO
 	DEBUG
 )
 
+var levelNames = map[string]int{
+	"error": ERROR,
+	"warn":  WARN,
+	"info":  INFO,
+	"debug": DEBUG,
+}
+
+// ParseLevel returns the level named by s: debug, info, warn or error.
+func ParseLevel(s string) (int, error) {
+	level, ok := levelNames[strings.ToLower(s)]
+	if !ok {
+		return 0, fmt.Errorf("unknown log level: %s", s)
+	}
+	return level, nil
+}
+
+// LevelName returns the name of level, as accepted by ParseLevel.
+func LevelName(level int) string {
+	for name, l := range levelNames {
+		if l == level {
+			return name
+		}
+	}
+	return fmt.Sprintf("level(%d)", level)
+}
+
 type Logger struct {
 	golog.Logger
-	Level  int
+	level  int32
 	Prefix string
 }
 
@@ -32,7 +63,7 @@ var (
 
 func New(out io.Writer, prefix string, level int) *Logger {
 	l := &Logger{
-		Level:  level,
+		level:  int32(level),
 		Prefix: prefix,
 	}
 	l.Logger = *(golog.New(out, prefix, golog.LstdFlags))
@@ -41,28 +72,49 @@ func New(out io.Writer, prefix string, level int) *Logger {
 
 var DefaultLogger = New(os.Stderr, "", INFO)
 
+// Level returns the most verbose level l logs.
+func (l *Logger) Level() int {
+	return int(atomic.LoadInt32(&l.level))
+}
+
+// SetLevel changes the level of l.  It's safe to call while logging, and
+// applies to every following call.
+func (l *Logger) SetLevel(level int) {
+	atomic.StoreInt32(&l.level, int32(level))
+}
+
+func (l *Logger) enabled(level int) bool {
+	return l.Level() >= level
+}
+
 func (l *Logger) Debug(v ...interface{}) {
-	if l.Level < DEBUG {
+	if !l.enabled(DEBUG) {
 		return
 	}
 	l.Println(v...)
 }
 
 func (l *Logger) Debugf(fmt string, v ...interface{}) {
-	if l.Level < DEBUG {
+	if !l.enabled(DEBUG) {
 		return
 	}
 	l.Printf(fmt, v...)
 }
 
 func (l *Logger) Write(p []byte) (n int, err error) {
-	if l.Level < DEBUG {
+	if !l.enabled(DEBUG) {
 		return
 	}
 	l.Print(string(p))
 	return len(p), nil
 }
 
+// Level returns the level of DefaultLogger.
+func Level() int { return DefaultLogger.Level() }
+
+// SetLevel changes the level of DefaultLogger.
+func SetLevel(level int) { DefaultLogger.SetLevel(level) }
+
 func Debug(v ...interface{})                 { DefaultLogger.Debug(v...) }
 func Debugf(format string, v ...interface{}) { DefaultLogger.Debugf(format, v...) }
 func Fatal(v ...interface{}) {
@@ -95,15 +147,39 @@ func Errorln(v ...interface{}) {
 }
 
 func Warn(v ...interface{}) {
+	if !DefaultLogger.enabled(WARN) {
+		return
+	}
 	DefaultLogger.Print(yellow(v...))
 }
 func Warnf(format string, v ...interface{}) {
+	if !DefaultLogger.enabled(WARN) {
+		return
+	}
 	DefaultLogger.Print(yellowf(format, v...))
 }
 func Warnln(v ...interface{}) {
+	if !DefaultLogger.enabled(WARN) {
+		return
+	}
 	DefaultLogger.Print(yellowln(v...))
 }
 
-func Print(v ...interface{})                 { DefaultLogger.Print(v...) }
-func Printf(format string, v ...interface{}) { DefaultLogger.Printf(format, v...) }
-func Println(v ...interface{})               { DefaultLogger.Println(v...) }
+func Print(v ...interface{}) {
+	if !DefaultLogger.enabled(INFO) {
+		return
+	}
+	DefaultLogger.Print(v...)
+}
+func Printf(format string, v ...interface{}) {
+	if !DefaultLogger.enabled(INFO) {
+		return
+	}
+	DefaultLogger.Printf(format, v...)
+}
+func Println(v ...interface{}) {
+	if !DefaultLogger.enabled(INFO) {
+		return
+	}
+	DefaultLogger.Println(v...)
+}
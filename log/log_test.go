@@ -0,0 +1,35 @@
+package log
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestLevelFiltering(t *testing.T) {
+	buf := &bytes.Buffer{}
+	DefaultLogger.SetOutput(buf)
+	DefaultLogger.SetFlags(0)
+	defer SetLevel(Level())
+
+	for _, tt := range []struct {
+		level int
+		want  string
+	}{
+		{ERROR, "error\n"},
+		{WARN, "error\nwarn\n"},
+		{INFO, "error\nwarn\ninfo\n"},
+		{DEBUG, "error\nwarn\ninfo\ndebug\n"},
+	} {
+		buf.Reset()
+		SetLevel(tt.level)
+
+		Errorln("error")
+		Warnln("warn")
+		Println("info")
+		Debug("debug")
+
+		if buf.String() != tt.want {
+			t.Errorf("level %s logged %q, want %q", LevelName(tt.level), buf.String(), tt.want)
+		}
+	}
+}
@@ -4,14 +4,24 @@ type RegistryBackend interface {
 
 	// Keys
 	Keys(key string) ([]string, error)
-	Delete(key string) (int, error)
+	Scan(pattern string) ([]string, error)
+	Delete(keys ...string) (int, error)
 	Expire(key string, ttl uint64) (int, error)
 	Ttl(key string) (int, error)
 
 	Connect()
 	Reconnect()
+	Ping() error
 
 	// Maps
 	Set(key, field string, value string) (string, error)
 	Get(key, field string) (string, error)
+	GetAll(key string) (map[string]string, error)
+
+	// SetIfNewer sets field and the key's ttl only if id is not older than
+	// the id stored by a previous SetIfNewer.
+	SetIfNewer(key string, id int64, field, value string, ttl uint64) (bool, error)
+
+	// MultiGet returns field and the ttl of each key in one round trip
+	MultiGet(keys []string, field string) ([]string, []int, error)
 }
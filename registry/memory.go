@@ -2,7 +2,9 @@ package registry
 
 import (
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 )
 
 type Value struct {
@@ -11,7 +13,9 @@ type Value struct {
 }
 
 type MemoryBackend struct {
+	sync.Mutex
 	maps map[string]map[string]string
+	ttls map[string]int
 
 	MembersFunc      func(key string) ([]string, error)
 	KeysFunc         func(key string) ([]string, error)
@@ -24,6 +28,7 @@ type MemoryBackend struct {
 func NewMemoryBackend() *MemoryBackend {
 	return &MemoryBackend{
 		maps: make(map[string]map[string]string),
+		ttls: make(map[string]int),
 	}
 }
 
@@ -33,11 +38,18 @@ func (r *MemoryBackend) Connect() {
 func (r *MemoryBackend) Reconnect() {
 }
 
+func (r *MemoryBackend) Ping() error {
+	return nil
+}
+
 func (r *MemoryBackend) Keys(key string) ([]string, error) {
 	if r.KeysFunc != nil {
 		return r.KeysFunc(key)
 	}
 
+	r.Lock()
+	defer r.Unlock()
+
 	keys := []string{}
 	rp := strings.NewReplacer("*", `.*`)
 	p := rp.Replace(key)
@@ -52,26 +64,109 @@ func (r *MemoryBackend) Keys(key string) ([]string, error) {
 	return keys, nil
 }
 
+func (r *MemoryBackend) Scan(pattern string) ([]string, error) {
+	return r.Keys(pattern)
+}
+
 func (r *MemoryBackend) Expire(key string, ttl uint64) (int, error) {
-	return 0, nil
+	r.Lock()
+	defer r.Unlock()
+
+	if _, ok := r.maps[key]; !ok {
+		return 0, nil
+	}
+	r.ttls[key] = int(ttl)
+	return 1, nil
 }
 
 func (r *MemoryBackend) Ttl(key string) (int, error) {
-	return 0, nil
+	r.Lock()
+	defer r.Unlock()
+	return r.ttl(key), nil
 }
 
-func (r *MemoryBackend) Delete(key string) (int, error) {
-	if _, ok := r.maps[key]; ok {
-		delete(r.maps, key)
-		return 1, nil
+func (r *MemoryBackend) ttl(key string) int {
+	if _, ok := r.maps[key]; !ok {
+		return -2
+	}
+	if ttl, ok := r.ttls[key]; ok {
+		return ttl
 	}
-	return 0, nil
+	return -1
+}
+
+func (r *MemoryBackend) Delete(keys ...string) (int, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	deleted := 0
+	for _, key := range keys {
+		if _, ok := r.maps[key]; ok {
+			delete(r.maps, key)
+			delete(r.ttls, key)
+			deleted++
+		}
+	}
+	return deleted, nil
 }
 
 func (r *MemoryBackend) Set(key, field string, value string) (string, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.maps[key] == nil {
+		r.maps[key] = make(map[string]string)
+	}
+	r.maps[key][field] = value
 	return "OK", nil
 }
 
 func (r *MemoryBackend) Get(key, field string) (string, error) {
-	return "", nil
+	r.Lock()
+	defer r.Unlock()
+	return r.maps[key][field], nil
+}
+
+func (r *MemoryBackend) GetAll(key string) (map[string]string, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	values := make(map[string]string)
+	for k, v := range r.maps[key] {
+		values[k] = v
+	}
+	return values, nil
+}
+
+func (r *MemoryBackend) MultiGet(keys []string, field string) ([]string, []int, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	values := make([]string, len(keys))
+	ttls := make([]int, len(keys))
+	for i, key := range keys {
+		values[i] = r.maps[key][field]
+		ttls[i] = r.ttl(key)
+	}
+	return values, ttls, nil
+}
+
+func (r *MemoryBackend) SetIfNewer(key string, id int64, field, value string, ttl uint64) (bool, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	if current, ok := r.maps[key]["id"]; ok {
+		currentID, _ := strconv.ParseInt(current, 10, 64)
+		if currentID > id {
+			return false, nil
+		}
+	}
+
+	if r.maps[key] == nil {
+		r.maps[key] = make(map[string]string)
+	}
+	r.maps[key]["id"] = strconv.FormatInt(id, 10)
+	r.maps[key][field] = value
+	r.ttls[key] = int(ttl)
+	return true, nil
 }
@@ -1,25 +1,135 @@
 package registry
 
 import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/garyburd/redigo/redis"
+	"github.com/litl/galaxy/utils"
 )
 
+// setIfNewerScript writes a field along with its id, unless the hash already
+// holds a newer id, and sets the ttl in the same step.  Ids are compared as
+// decimal strings, by length and then digits, since Lua numbers are doubles
+// and can't tell apart UnixNano ids less than a microsecond or so apart.
+var setIfNewerScript = redis.NewScript(1, `
+local current = redis.call("HGET", KEYS[1], "id")
+-- negative ids, stored before ids were clamped at 0, are the oldest
+if current and current:sub(1, 1) ~= "-" and
+	(#current > #ARGV[1] or (#current == #ARGV[1] and current > ARGV[1])) then
+	return 0
+end
+redis.call("HMSET", KEYS[1], "id", ARGV[1], ARGV[2], ARGV[3])
+redis.call("EXPIRE", KEYS[1], ARGV[4])
+return 1
+`)
+
+const (
+	reconnectBaseDelay = 100 * time.Millisecond
+	reconnectMaxDelay  = 30 * time.Second
+
+	// replicaRetryDelay is how long a replica that failed to connect is
+	// skipped before reads try it again.
+	replicaRetryDelay = 5 * time.Second
+)
+
+// ErrReconnecting is returned without contacting redis while waiting to
+// reconnect after a failure.
+var ErrReconnecting = errors.New("redis unavailable, waiting to reconnect")
+
 type RedisBackend struct {
-	redisPool redis.Pool
 	RedisHost string
+
+	// ReplicaHosts are read replicas of RedisHost.  Reads made through
+	// Replicas are spread across them and may be slightly stale; every
+	// other operation goes to RedisHost.
+	ReplicaHosts []string
+
+	// dial overrides the redis dialer, for tests.
+	dial func(host string) (redis.Conn, error)
+
+	// mu guards the pools, which Reconnect replaces while other goroutines
+	// are using the backend, and the reconnect and replica state.
+	mu          sync.Mutex
+	redisPool   *redis.Pool
+	failures    uint
+	retryAt     time.Time
+	lastSuccess time.Time
+
+	replicas    []*replica
+	nextReplica int
+
+	// Instrumented enables the per command counters returned by Stats.
+	Instrumented bool
+	stats        opStats
 }
 
+type replica struct {
+	host      string
+	pool      *redis.Pool
+	downUntil time.Time
+}
+
+// errorConn fails every operation with err.
+type errorConn struct {
+	err error
+}
+
+func (c errorConn) Close() error                                   { return nil }
+func (c errorConn) Err() error                                     { return c.err }
+func (c errorConn) Do(string, ...interface{}) (interface{}, error) { return nil, c.err }
+func (c errorConn) Send(string, ...interface{}) error              { return c.err }
+func (c errorConn) Flush() error                                   { return c.err }
+func (c errorConn) Receive() (interface{}, error)                  { return nil, c.err }
+
 func (r *RedisBackend) Connect() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.connect()
+}
+
+// connect builds new pools.  Replicas already known keep their state, so a
+// replica that's down stays skipped across reconnects.  r.mu must be held.
+func (r *RedisBackend) connect() {
+	r.redisPool = r.newPool(r.RedisHost)
+
+	known := make(map[string]*replica)
+	for _, rep := range r.replicas {
+		known[rep.host] = rep
+	}
+
+	replicas := []*replica{}
+	for _, host := range r.ReplicaHosts {
+		rep := known[host]
+		if rep == nil {
+			rep = &replica{host: host}
+		}
+		rep.pool = r.newPool(host)
+		replicas = append(replicas, rep)
+	}
+	r.replicas = replicas
+}
+
+func (r *RedisBackend) newPool(host string) *redis.Pool {
 	rwTimeout := 5 * time.Second
 
-	r.redisPool = redis.Pool{
+	dial := func() (redis.Conn, error) {
+		return redis.DialTimeout("tcp", host, rwTimeout, rwTimeout, rwTimeout)
+	}
+	if r.dial != nil {
+		dial = func() (redis.Conn, error) {
+			return r.dial(host)
+		}
+	}
+
+	return &redis.Pool{
 		MaxIdle:     1,
 		IdleTimeout: 120 * time.Second,
-		Dial: func() (redis.Conn, error) {
-			return redis.DialTimeout("tcp", r.RedisHost, rwTimeout, rwTimeout, rwTimeout)
-		},
+		Dial:        dial,
 		// test every connection for now
 		TestOnBorrow: func(c redis.Conn, t time.Time) error {
 			_, err := c.Do("PING")
@@ -31,13 +141,216 @@ func (r *RedisBackend) Connect() {
 	}
 }
 
+// Reconnect rebuilds the pool after a failed operation.  Repeated failures
+// back off exponentially, with jitter, up to reconnectMaxDelay.  Until then
+// operations fail fast with ErrReconnecting.
 func (r *RedisBackend) Reconnect() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	if now.Before(r.retryAt) {
+		return
+	}
+
+	delay := reconnectMaxDelay
+	if r.failures < 16 {
+		delay = reconnectBaseDelay << r.failures
+	}
+	if delay > reconnectMaxDelay {
+		delay = reconnectMaxDelay
+	}
+	r.failures++
+
+	// wait between half and all of delay so clients don't reconnect in step
+	delay = delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+	r.retryAt = now.Add(delay)
+
 	r.redisPool.Close()
-	r.Connect()
+	for _, rep := range r.replicas {
+		rep.pool.Close()
+	}
+	r.connect()
+}
+
+// LastSuccess returns when a connection was last obtained from redis.
+func (r *RedisBackend) LastSuccess() time.Time {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.lastSuccess
+}
+
+// getConn returns a pooled connection, or one that fails with
+// ErrReconnecting while backing off.
+func (r *RedisBackend) getConn() redis.Conn {
+	r.mu.Lock()
+	backingOff := time.Now().Before(r.retryAt)
+	pool := r.redisPool
+	r.mu.Unlock()
+
+	if backingOff {
+		return errorConn{ErrReconnecting}
+	}
+
+	conn := pool.Get()
+	if conn.Err() == nil {
+		r.mu.Lock()
+		r.failures = 0
+		r.retryAt = time.Time{}
+		r.lastSuccess = time.Now()
+		r.mu.Unlock()
+	}
+	return r.instrument(conn)
+}
+
+// getReadConn returns a connection to one of the replicas for a read only
+// operation.  It falls back to the primary when there are no replicas or
+// none of them can be reached.
+func (r *RedisBackend) getReadConn() redis.Conn {
+	r.mu.Lock()
+	replicas := r.replicas
+	start := r.nextReplica
+	r.nextReplica++
+	r.mu.Unlock()
+
+	for i := range replicas {
+		rep := replicas[(start+i)%len(replicas)]
+
+		r.mu.Lock()
+		down := time.Now().Before(rep.downUntil)
+		pool := rep.pool
+		r.mu.Unlock()
+		if down {
+			continue
+		}
+
+		conn := pool.Get()
+		if conn.Err() == nil {
+			return r.instrument(conn)
+		}
+		conn.Close()
+
+		r.mu.Lock()
+		rep.downUntil = time.Now().Add(replicaRetryDelay)
+		r.mu.Unlock()
+	}
+	return r.getConn()
+}
+
+// replicaBackend is a RedisBackend whose reads go to the replicas.
+type replicaBackend struct {
+	*RedisBackend
+}
+
+// Replicas returns a view of the backend that serves reads from the replicas
+// when there are any.  Its reads can be stale, so they're only for listing
+// and status; a read that decides a write must use the backend itself.
+func (r *RedisBackend) Replicas() RegistryBackend {
+	return replicaBackend{r}
+}
+
+func (r replicaBackend) Scan(pattern string) ([]string, error) {
+	return r.scan(r.getReadConn(), pattern)
+}
+
+func (r replicaBackend) Keys(key string) ([]string, error) {
+	return r.keys(r.getReadConn(), key)
+}
+
+func (r replicaBackend) Ttl(key string) (int, error) {
+	return r.ttl(r.getReadConn(), key)
+}
+
+func (r replicaBackend) Members(key string) ([]string, error) {
+	return r.members(r.getReadConn(), key)
+}
+
+func (r replicaBackend) Get(key, field string) (string, error) {
+	return r.get(r.getReadConn(), key, field)
+}
+
+func (r replicaBackend) MultiGet(keys []string, field string) ([]string, []int, error) {
+	return r.multiGet(r.getReadConn(), keys, field)
+}
+
+func (r replicaBackend) GetAll(key string) (map[string]string, error) {
+	return r.getAll(r.getReadConn(), key)
+}
+
+func (r *RedisBackend) Ping() error {
+	conn := r.getConn()
+	defer conn.Close()
+
+	if conn.Err() != nil {
+		conn.Close()
+		r.Reconnect()
+		return conn.Err()
+	}
+
+	_, err := conn.Do("PING")
+	if err != nil {
+		r.Reconnect()
+	}
+	return err
+}
+
+// Scan returns the keys matching pattern.  It iterates with SCAN rather
+// than KEYS so listing a large keyspace doesn't block redis.
+func (r *RedisBackend) Scan(pattern string) ([]string, error) {
+	return r.scan(r.getConn(), pattern)
+}
+
+func (r *RedisBackend) scan(conn redis.Conn, pattern string) ([]string, error) {
+	defer conn.Close()
+
+	if conn.Err() != nil {
+		conn.Close()
+		r.Reconnect()
+		return nil, conn.Err()
+	}
+
+	keys := []string{}
+	seen := make(map[string]bool)
+	cursor := "0"
+	for {
+		reply, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", pattern, "COUNT", "1000"))
+		if err != nil {
+			return nil, err
+		}
+
+		if len(reply) != 2 {
+			return nil, fmt.Errorf("unexpected SCAN reply of length %d", len(reply))
+		}
+
+		cursor, err = redis.String(reply[0], nil)
+		if err != nil {
+			return nil, err
+		}
+
+		batch, err := redis.Strings(reply[1], nil)
+		if err != nil {
+			return nil, err
+		}
+
+		// SCAN may return a key more than once
+		for _, k := range batch {
+			if !seen[k] {
+				seen[k] = true
+				keys = append(keys, k)
+			}
+		}
+
+		if cursor == "0" {
+			return keys, nil
+		}
+	}
 }
 
 func (r *RedisBackend) Keys(key string) ([]string, error) {
-	conn := r.redisPool.Get()
+	return r.keys(r.getConn(), key)
+}
+
+func (r *RedisBackend) keys(conn redis.Conn, key string) ([]string, error) {
 	defer conn.Close()
 
 	if conn.Err() != nil {
@@ -50,7 +363,7 @@ func (r *RedisBackend) Keys(key string) ([]string, error) {
 }
 
 func (r *RedisBackend) Expire(key string, ttl uint64) (int, error) {
-	conn := r.redisPool.Get()
+	conn := r.getConn()
 	defer conn.Close()
 
 	if conn.Err() != nil {
@@ -63,7 +376,10 @@ func (r *RedisBackend) Expire(key string, ttl uint64) (int, error) {
 }
 
 func (r *RedisBackend) Ttl(key string) (int, error) {
-	conn := r.redisPool.Get()
+	return r.ttl(r.getConn(), key)
+}
+
+func (r *RedisBackend) ttl(conn redis.Conn, key string) (int, error) {
 	defer conn.Close()
 
 	if conn.Err() != nil {
@@ -75,8 +391,12 @@ func (r *RedisBackend) Ttl(key string) (int, error) {
 	return redis.Int(conn.Do("TTL", key))
 }
 
-func (r *RedisBackend) Delete(key string) (int, error) {
-	conn := r.redisPool.Get()
+func (r *RedisBackend) Delete(keys ...string) (int, error) {
+	if len(keys) == 0 {
+		return 0, nil
+	}
+
+	conn := r.getConn()
 	defer conn.Close()
 
 	if conn.Err() != nil {
@@ -85,11 +405,11 @@ func (r *RedisBackend) Delete(key string) (int, error) {
 		return 0, conn.Err()
 	}
 
-	return redis.Int(conn.Do("DEL", key))
+	return redis.Int(conn.Do("DEL", redis.Args{}.AddFlat(keys)...))
 }
 
 func (r *RedisBackend) AddMember(key, value string) (int, error) {
-	conn := r.redisPool.Get()
+	conn := r.getConn()
 	defer conn.Close()
 
 	if conn.Err() != nil {
@@ -102,7 +422,7 @@ func (r *RedisBackend) AddMember(key, value string) (int, error) {
 }
 
 func (r *RedisBackend) RemoveMember(key, value string) (int, error) {
-	conn := r.redisPool.Get()
+	conn := r.getConn()
 	defer conn.Close()
 
 	if conn.Err() != nil {
@@ -115,7 +435,10 @@ func (r *RedisBackend) RemoveMember(key, value string) (int, error) {
 }
 
 func (r *RedisBackend) Members(key string) ([]string, error) {
-	conn := r.redisPool.Get()
+	return r.members(r.getConn(), key)
+}
+
+func (r *RedisBackend) members(conn redis.Conn, key string) ([]string, error) {
 	defer conn.Close()
 
 	if conn.Err() != nil {
@@ -128,7 +451,7 @@ func (r *RedisBackend) Members(key string) ([]string, error) {
 }
 
 func (r *RedisBackend) Set(key, field string, value string) (string, error) {
-	conn := r.redisPool.Get()
+	conn := r.getConn()
 	defer conn.Close()
 
 	if conn.Err() != nil {
@@ -141,7 +464,10 @@ func (r *RedisBackend) Set(key, field string, value string) (string, error) {
 }
 
 func (r *RedisBackend) Get(key, field string) (string, error) {
-	conn := r.redisPool.Get()
+	return r.get(r.getConn(), key, field)
+}
+
+func (r *RedisBackend) get(conn redis.Conn, key, field string) (string, error) {
 	defer conn.Close()
 
 	if conn.Err() != nil {
@@ -158,8 +484,69 @@ func (r *RedisBackend) Get(key, field string) (string, error) {
 	return ret, err
 }
 
+func (r *RedisBackend) SetIfNewer(key string, id int64, field, value string, ttl uint64) (bool, error) {
+	conn := r.getConn()
+	defer conn.Close()
+
+	if conn.Err() != nil {
+		conn.Close()
+		r.Reconnect()
+		return false, conn.Err()
+	}
+
+	// the script compares unsigned decimals
+	if id < 0 {
+		id = 0
+	}
+
+	return redis.Bool(setIfNewerScript.Do(conn, key, strconv.FormatInt(id, 10), field, value,
+		strconv.FormatUint(ttl, 10)))
+}
+
+func (r *RedisBackend) MultiGet(keys []string, field string) ([]string, []int, error) {
+	return r.multiGet(r.getConn(), keys, field)
+}
+
+func (r *RedisBackend) multiGet(conn redis.Conn, keys []string, field string) ([]string, []int, error) {
+	defer conn.Close()
+
+	if conn.Err() != nil {
+		conn.Close()
+		r.Reconnect()
+		return nil, nil, conn.Err()
+	}
+
+	for _, key := range keys {
+		conn.Send("HGET", key, field)
+		conn.Send("TTL", key)
+	}
+
+	err := conn.Flush()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	values := make([]string, len(keys))
+	ttls := make([]int, len(keys))
+	for i := range keys {
+		values[i], err = redis.String(conn.Receive())
+		if err != nil && err != redis.ErrNil {
+			return nil, nil, err
+		}
+
+		ttls[i], err = redis.Int(conn.Receive())
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return values, ttls, nil
+}
+
 func (r *RedisBackend) GetAll(key string) (map[string]string, error) {
-	conn := r.redisPool.Get()
+	return r.getAll(r.getConn(), key)
+}
+
+func (r *RedisBackend) getAll(conn redis.Conn, key string) (map[string]string, error) {
 	defer conn.Close()
 
 	if conn.Err() != nil {
@@ -173,18 +560,12 @@ func (r *RedisBackend) GetAll(key string) (map[string]string, error) {
 		return nil, err
 	}
 
-	serialized := make(map[string]string)
-	for i := 0; i < len(matches); i += 2 {
-		key := string(matches[i].([]byte))
-		value := string(matches[i+1].([]byte))
-		serialized[key] = value
-	}
-	return serialized, nil
+	return utils.HashValues(key, matches)
 
 }
 
 func (r *RedisBackend) SetMulti(key string, values map[string]string) (string, error) {
-	conn := r.redisPool.Get()
+	conn := r.getConn()
 	defer conn.Close()
 
 	if conn.Err() != nil {
@@ -198,7 +579,7 @@ func (r *RedisBackend) SetMulti(key string, values map[string]string) (string, e
 }
 
 func (r *RedisBackend) DeleteMulti(key string, fields ...string) (int, error) {
-	conn := r.redisPool.Get()
+	conn := r.getConn()
 	defer conn.Close()
 
 	if conn.Err() != nil {
@@ -0,0 +1,189 @@
+package registry
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// OpStats counts the calls made for one redis command.  The percentiles are
+// the upper bounds of the latency buckets they fall in, so they're within a
+// factor of two of the actual value.
+type OpStats struct {
+	Count  int64         `json:"count"`
+	Errors int64         `json:"errors"`
+	Total  time.Duration `json:"total"`
+	Max    time.Duration `json:"max"`
+	P50    time.Duration `json:"p50"`
+	P90    time.Duration `json:"p90"`
+	P99    time.Duration `json:"p99"`
+}
+
+// latencyBuckets are the upper bounds of the latency histogram kept for each
+// command, doubling from 50µs to about 6.5s.  Slower calls are counted in a
+// final bucket bounded by the slowest call.
+var latencyBuckets = func() []time.Duration {
+	buckets := []time.Duration{}
+	for d := 50 * time.Microsecond; d < 10*time.Second; d *= 2 {
+		buckets = append(buckets, d)
+	}
+	return buckets
+}()
+
+type opCounter struct {
+	OpStats
+	buckets []int64
+}
+
+func (c *opCounter) add(d time.Duration) {
+	for i, bound := range latencyBuckets {
+		if d <= bound {
+			c.buckets[i]++
+			return
+		}
+	}
+	c.buckets[len(latencyBuckets)]++
+}
+
+// percentile returns the upper bound of the bucket holding the p'th
+// percentile call.
+func (c *opCounter) percentile(p float64) time.Duration {
+	if c.Count == 0 {
+		return 0
+	}
+
+	rank := int64(p*float64(c.Count) + 0.5)
+	if rank < 1 {
+		rank = 1
+	}
+
+	seen := int64(0)
+	for i, n := range c.buckets {
+		seen += n
+		if seen >= rank && i < len(latencyBuckets) {
+			if latencyBuckets[i] > c.Max {
+				return c.Max
+			}
+			return latencyBuckets[i]
+		}
+	}
+	return c.Max
+}
+
+// Mean returns the average duration of a call.
+func (s OpStats) Mean() time.Duration {
+	if s.Count == 0 {
+		return 0
+	}
+	return s.Total / time.Duration(s.Count)
+}
+
+type opStats struct {
+	sync.Mutex
+	ops map[string]*opCounter
+}
+
+func (s *opStats) record(cmd string, d time.Duration, err error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.ops == nil {
+		s.ops = make(map[string]*opCounter)
+	}
+
+	op := s.ops[cmd]
+	if op == nil {
+		op = &opCounter{buckets: make([]int64, len(latencyBuckets)+1)}
+		s.ops[cmd] = op
+	}
+
+	op.Count++
+	op.Total += d
+	op.add(d)
+	if d > op.Max {
+		op.Max = d
+	}
+	if err != nil {
+		op.Errors++
+	}
+}
+
+func (s *opStats) snapshot() map[string]OpStats {
+	s.Lock()
+	defer s.Unlock()
+
+	ops := make(map[string]OpStats)
+	for cmd, op := range s.ops {
+		stats := op.OpStats
+		stats.P50 = op.percentile(0.5)
+		stats.P90 = op.percentile(0.9)
+		stats.P99 = op.percentile(0.99)
+		ops[cmd] = stats
+	}
+	return ops
+}
+
+// timedConn records the duration and outcome of each command sent on conn.
+// Pipelined commands are timed from the previous Flush or Receive, so a
+// pipeline's total time is split across its replies.
+type timedConn struct {
+	redis.Conn
+	stats   *opStats
+	pending []string
+	last    time.Time
+}
+
+func (c *timedConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	start := time.Now()
+	reply, err := c.Conn.Do(cmd, args...)
+	if cmd != "" {
+		c.stats.record(cmd, time.Since(start), commandError(cmd, err))
+	}
+	return reply, err
+}
+
+// commandError returns err unless it's an expected reply, like the NOSCRIPT
+// error that has redis.Script load a script with EVAL.
+func commandError(cmd string, err error) error {
+	if e, ok := err.(redis.Error); ok && cmd == "EVALSHA" && strings.HasPrefix(string(e), "NOSCRIPT") {
+		return nil
+	}
+	return err
+}
+
+func (c *timedConn) Send(cmd string, args ...interface{}) error {
+	c.pending = append(c.pending, cmd)
+	return c.Conn.Send(cmd, args...)
+}
+
+func (c *timedConn) Flush() error {
+	c.last = time.Now()
+	return c.Conn.Flush()
+}
+
+func (c *timedConn) Receive() (interface{}, error) {
+	reply, err := c.Conn.Receive()
+	if len(c.pending) > 0 {
+		now := time.Now()
+		c.stats.record(c.pending[0], now.Sub(c.last), commandError(c.pending[0], err))
+		c.pending = c.pending[1:]
+		c.last = now
+	}
+	return reply, err
+}
+
+// instrument wraps conn to record command timings when Instrumented is set.
+func (r *RedisBackend) instrument(conn redis.Conn) redis.Conn {
+	if !r.Instrumented {
+		return conn
+	}
+	return &timedConn{Conn: conn, stats: &r.stats}
+}
+
+// Stats returns the counters for each redis command sent since the backend
+// was created.  It's empty unless Instrumented is set.
+func (r *RedisBackend) Stats() map[string]OpStats {
+	return r.stats.snapshot()
+}
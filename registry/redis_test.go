@@ -0,0 +1,517 @@
+package registry
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/garyburd/redigo/redis"
+)
+
+type testConn struct{}
+
+func (c testConn) Close() error                                   { return nil }
+func (c testConn) Err() error                                     { return nil }
+func (c testConn) Do(string, ...interface{}) (interface{}, error) { return []interface{}{}, nil }
+func (c testConn) Send(string, ...interface{}) error              { return nil }
+func (c testConn) Flush() error                                   { return nil }
+func (c testConn) Receive() (interface{}, error)                  { return nil, nil }
+
+func TestReconnectBackoff(t *testing.T) {
+	up := false
+	dials := 0
+
+	r := &RedisBackend{}
+	r.dial = func(host string) (redis.Conn, error) {
+		dials++
+		if !up {
+			return nil, errors.New("connection refused")
+		}
+		return testConn{}, nil
+	}
+	r.Connect()
+
+	if _, err := r.Keys("*"); err == nil {
+		t.Fatal("Keys() should fail while redis is down")
+	}
+
+	// fails fast without dialing while backing off
+	dials = 0
+	if _, err := r.Keys("*"); err != ErrReconnecting {
+		t.Fatalf("Keys() error = %v, want %v", err, ErrReconnecting)
+	}
+	if dials != 0 {
+		t.Errorf("dialed %d times during backoff, want 0", dials)
+	}
+
+	// a second failure backs off for longer
+	first := r.retryAt.Sub(time.Now())
+	r.retryAt = time.Time{}
+	r.Keys("*")
+	if second := r.retryAt.Sub(time.Now()); second <= first/2 {
+		t.Errorf("backoff after two failures = %s, want more than %s", second, first/2)
+	}
+	if r.retryAt.Sub(time.Now()) > reconnectMaxDelay {
+		t.Errorf("backoff exceeds %s", reconnectMaxDelay)
+	}
+
+	up = true
+	r.retryAt = time.Time{}
+	if _, err := r.Keys("*"); err != nil {
+		t.Fatal(err)
+	}
+
+	if r.failures != 0 {
+		t.Errorf("failures = %d after recovering, want 0", r.failures)
+	}
+
+	if time.Since(r.LastSuccess()) > time.Second {
+		t.Errorf("LastSuccess() = %s, want now", r.LastSuccess())
+	}
+}
+
+type hostConn struct {
+	testConn
+	host string
+	cmds *[]string
+}
+
+func (c hostConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	*c.cmds = append(*c.cmds, c.host+" "+cmd)
+	return c.testConn.Do(cmd, args...)
+}
+
+func TestReplicaReads(t *testing.T) {
+	cmds := []string{}
+	replicaUp := true
+
+	r := &RedisBackend{
+		RedisHost:    "primary",
+		ReplicaHosts: []string{"replica"},
+	}
+	r.dial = func(host string) (redis.Conn, error) {
+		if host == "replica" && !replicaUp {
+			return nil, errors.New("connection refused")
+		}
+		return hostConn{host: host, cmds: &cmds}, nil
+	}
+	r.Connect()
+
+	// the pool may PING a connection before use, so only the commands
+	// themselves are checked
+	sent := func() []string {
+		sent := []string{}
+		for _, cmd := range cmds {
+			if !strings.HasSuffix(cmd, " PING") {
+				sent = append(sent, cmd)
+			}
+		}
+		return sent
+	}
+
+	r.Replicas().Keys("*")
+	r.Keys("*")
+	r.Expire("key", 60)
+	want := []string{"replica KEYS", "primary KEYS", "primary EXPIRE"}
+	if strings.Join(sent(), ",") != strings.Join(want, ",") {
+		t.Errorf("commands = %v, want %v", sent(), want)
+	}
+
+	// reads fall back to the primary while the replica is down
+	replicaUp = false
+	r.Connect()
+	cmds = nil
+	if _, err := r.Replicas().Keys("*"); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(sent(), ",") != "primary KEYS" {
+		t.Errorf("commands = %v, want KEYS on the primary", sent())
+	}
+
+	if !time.Now().Before(r.replicas[0].downUntil) {
+		t.Errorf("replica not marked down after failing to connect")
+	}
+}
+
+func TestRegistryReplicaReads(t *testing.T) {
+	cmds := []string{}
+
+	b := &RedisBackend{
+		RedisHost:    "primary",
+		ReplicaHosts: []string{"replica"},
+	}
+	b.dial = func(host string) (redis.Conn, error) {
+		return hostConn{host: host, cmds: &cmds}, nil
+	}
+	b.Connect()
+
+	r := NewServiceRegistry(DefaultTTL)
+	r.backend = b
+
+	// reads that decide a write go to the primary
+	c := newTestContainer(testContainerID, "app", time.Now())
+	r.RegisterService("dev", "web", "10.0.0.1", c)
+	r.UnRegisterService("dev", "web", "10.0.0.1", c)
+	r.ReapHost("dev", "web", "10.0.0.1", func() ([]string, error) { return nil, nil })
+	r.MigrateSchema(false)
+
+	for _, cmd := range cmds {
+		if strings.HasPrefix(cmd, "replica ") && cmd != "replica PING" {
+			t.Errorf("%s sent to a replica", cmd)
+		}
+	}
+
+	cmds = nil
+	r.ListRegistrations("dev")
+	if len(cmds) == 0 || cmds[len(cmds)-1] != "replica SCAN" {
+		t.Errorf("commands = %v, want SCAN on the replica", cmds)
+	}
+}
+
+func TestReconnectKeepsReplicaState(t *testing.T) {
+	r := &RedisBackend{
+		RedisHost:    "primary",
+		ReplicaHosts: []string{"replica"},
+	}
+	r.dial = func(host string) (redis.Conn, error) {
+		if host == "replica" {
+			return nil, errors.New("connection refused")
+		}
+		return testConn{}, nil
+	}
+	r.Connect()
+
+	r.Replicas().Keys("*")
+	downUntil := r.replicas[0].downUntil
+	if downUntil.IsZero() {
+		t.Fatal("replica not marked down after failing to connect")
+	}
+
+	r.Reconnect()
+	if !r.replicas[0].downUntil.Equal(downUntil) {
+		t.Errorf("downUntil = %s after Reconnect(), want %s", r.replicas[0].downUntil, downUntil)
+	}
+}
+
+func TestReconnectConcurrent(t *testing.T) {
+	r := &RedisBackend{
+		RedisHost:    "primary",
+		ReplicaHosts: []string{"replica"},
+	}
+	r.dial = func(host string) (redis.Conn, error) {
+		return testConn{}, nil
+	}
+	r.Connect()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				r.Replicas().Keys("*")
+				r.Expire("key", 60)
+			}
+		}()
+	}
+
+	for j := 0; j < 50; j++ {
+		r.mu.Lock()
+		r.retryAt = time.Time{}
+		r.mu.Unlock()
+		r.Reconnect()
+	}
+	wg.Wait()
+}
+
+func TestInstrumentedStats(t *testing.T) {
+	cmds := []string{}
+
+	r := &RedisBackend{RedisHost: "primary"}
+	r.dial = func(host string) (redis.Conn, error) {
+		return hostConn{host: host, cmds: &cmds}, nil
+	}
+	r.Connect()
+
+	r.Keys("*")
+	if len(r.Stats()) != 0 {
+		t.Fatalf("Stats() = %v, want nothing while not instrumented", r.Stats())
+	}
+
+	r.Instrumented = true
+	r.Keys("*")
+	r.Keys("*")
+	r.MultiGet([]string{"a"}, "location")
+
+	stats := r.Stats()
+	if stats["KEYS"].Count != 2 {
+		t.Errorf("KEYS count = %d, want 2", stats["KEYS"].Count)
+	}
+
+	if stats["HGET"].Count != 1 || stats["TTL"].Count != 1 {
+		t.Errorf("pipelined counts = %d HGET, %d TTL, want 1 each", stats["HGET"].Count, stats["TTL"].Count)
+	}
+
+	if _, ok := stats["PING"]; ok {
+		t.Errorf("Stats() counted the pool's connection test")
+	}
+}
+
+func TestStatsPercentiles(t *testing.T) {
+	s := &opStats{}
+	for i := 0; i < 98; i++ {
+		s.record("GET", 40*time.Microsecond, nil)
+	}
+	s.record("GET", 3*time.Millisecond, nil)
+	s.record("GET", 20*time.Second, nil)
+
+	get := s.snapshot()["GET"]
+	if get.P50 != 50*time.Microsecond || get.P90 != 50*time.Microsecond {
+		t.Errorf("P50, P90 = %s, %s, want 50µs", get.P50, get.P90)
+	}
+
+	if get.P99 != 3200*time.Microsecond {
+		t.Errorf("P99 = %s, want %s", get.P99, 3200*time.Microsecond)
+	}
+
+	if get.Max != 20*time.Second {
+		t.Errorf("Max = %s, want 20s", get.Max)
+	}
+}
+
+func TestStatsNoScript(t *testing.T) {
+	s := &opStats{}
+	c := &timedConn{Conn: errConn{err: redis.Error("NOSCRIPT No matching script")}, stats: s}
+	c.Do("EVALSHA", "sha", "1", "key")
+
+	c.Conn = errConn{err: redis.Error("ERR wrong number of arguments")}
+	c.Do("HGET", "key")
+
+	stats := s.snapshot()
+	if stats["EVALSHA"].Count != 1 || stats["EVALSHA"].Errors != 0 {
+		t.Errorf("EVALSHA = %+v, want 1 call and no errors", stats["EVALSHA"])
+	}
+
+	if stats["HGET"].Errors != 1 {
+		t.Errorf("HGET errors = %d, want 1", stats["HGET"].Errors)
+	}
+}
+
+// errConn fails every command with err.
+type errConn struct {
+	testConn
+	err error
+}
+
+func (c errConn) Do(string, ...interface{}) (interface{}, error) { return nil, c.err }
+
+func TestPublishStats(t *testing.T) {
+	sent := [][]interface{}{}
+
+	b := &RedisBackend{RedisHost: "primary", Instrumented: true}
+	b.dial = func(host string) (redis.Conn, error) {
+		return argsConn{args: &sent}, nil
+	}
+	b.Connect()
+
+	r := NewServiceRegistry(DefaultTTL)
+	r.backend = b
+
+	b.Get("key", "location")
+	r.PublishStats("10.0.0.1")
+
+	published := ""
+	for _, args := range sent {
+		if args[0] == "HMSET" && args[1] == statsKey && args[2] == "10.0.0.1" {
+			published = args[3].(string)
+		}
+	}
+	if published == "" {
+		t.Fatalf("commands = %v, want HMSET %s 10.0.0.1", sent, statsKey)
+	}
+
+	// read them back as another process would
+	other, mb := NewTestRegistry()
+	mb.Set(statsKey, "10.0.0.1", published)
+
+	stats, err := other.ListHostStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(stats) != 1 || stats[0].Host != "10.0.0.1" || stats[0].Ops["HGET"].Count != 1 {
+		t.Errorf("ListHostStats() = %+v, want 1 HGET from 10.0.0.1", stats)
+	}
+}
+
+// latencyConn serves registrations from keys, sleeping for delay on each
+// round trip to redis.
+type latencyConn struct {
+	testConn
+	delay    time.Duration
+	keys     []string
+	location string
+	cmds     *[]string
+	pending  []interface{}
+}
+
+func (c *latencyConn) reply(cmd string) interface{} {
+	switch cmd {
+	case "SCAN":
+		keys := []interface{}{}
+		for _, key := range c.keys {
+			keys = append(keys, []byte(key))
+		}
+		return []interface{}{[]byte("0"), keys}
+	case "HGET":
+		return []byte(c.location)
+	case "TTL":
+		return int64(60)
+	}
+	return nil
+}
+
+func (c *latencyConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	*c.cmds = append(*c.cmds, cmd)
+	time.Sleep(c.delay)
+	return c.reply(cmd), nil
+}
+
+func (c *latencyConn) Send(cmd string, args ...interface{}) error {
+	*c.cmds = append(*c.cmds, cmd)
+	c.pending = append(c.pending, c.reply(cmd))
+	return nil
+}
+
+func (c *latencyConn) Flush() error {
+	time.Sleep(c.delay)
+	return nil
+}
+
+func (c *latencyConn) Receive() (interface{}, error) {
+	reply := c.pending[0]
+	c.pending = c.pending[1:]
+	return reply, nil
+}
+
+// newLatencyRegistry returns a registry backed by a latencyConn holding a
+// registration for each of n containers on one host.
+func newLatencyRegistry(n int, delay time.Duration) (*ServiceRegistry, []*docker.Container, *[]string) {
+	cmds := []string{}
+	conn := &latencyConn{
+		delay:    delay,
+		location: `{"NAME": "app"}`,
+		cmds:     &cmds,
+	}
+
+	containers := []*docker.Container{}
+	for i := 0; i < n; i++ {
+		id := fmt.Sprintf("%012d%s", i, testContainerID[12:])
+		containers = append(containers, newTestContainer(id, "app", time.Now()))
+		conn.keys = append(conn.keys, path.Join("dev", "web", "hosts", "10.0.0.1", "app", id[0:12]))
+	}
+
+	b := &RedisBackend{RedisHost: "primary"}
+	b.dial = func(host string) (redis.Conn, error) {
+		return conn, nil
+	}
+	b.Connect()
+
+	r := NewServiceRegistry(DefaultTTL)
+	r.backend = b
+	return r, containers, &cmds
+}
+
+func TestListHostRegistrationsScan(t *testing.T) {
+	r, _, cmds := newLatencyRegistry(3, 0)
+
+	regs, err := r.ListHostRegistrations("dev", "web", "10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(regs["app"]) != 3 {
+		t.Errorf("ListHostRegistrations() = %d registrations, want 3", len(regs["app"]))
+	}
+
+	for _, cmd := range *cmds {
+		if cmd == "KEYS" {
+			t.Errorf("ListHostRegistrations() used KEYS: %v", *cmds)
+		}
+	}
+}
+
+// The benchmarks compare a status pass over 50 containers on a host, with
+// 100µs to redis, looking up each registration or fetching them together.
+func BenchmarkGetServiceRegistration(b *testing.B) {
+	r, containers, _ := newLatencyRegistry(50, 100*time.Microsecond)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		for _, container := range containers {
+			if _, err := r.GetServiceRegistration("dev", "web", "10.0.0.1", container); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkListHostRegistrations(b *testing.B) {
+	r, _, _ := newLatencyRegistry(50, 100*time.Microsecond)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := r.ListHostRegistrations("dev", "web", "10.0.0.1"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// argsConn records the arguments of each command.
+type argsConn struct {
+	testConn
+	args *[][]interface{}
+}
+
+func (c argsConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	*c.args = append(*c.args, append([]interface{}{cmd}, args...))
+	return int64(1), nil
+}
+
+func TestSetIfNewerIDs(t *testing.T) {
+	sent := [][]interface{}{}
+
+	r := &RedisBackend{RedisHost: "primary"}
+	r.dial = func(host string) (redis.Conn, error) {
+		return argsConn{args: &sent}, nil
+	}
+	r.Connect()
+
+	for _, tt := range []struct {
+		id   int64
+		want string
+	}{
+		// a double would round this to ...000000000
+		{1700000000000000001, "1700000000000000001"},
+		{-6795364578871345152, "0"},
+	} {
+		sent = nil
+		if _, err := r.SetIfNewer("key", tt.id, "location", "{}", 60); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(sent) == 0 || sent[len(sent)-1][0] != "EVALSHA" {
+			t.Fatalf("commands = %v, want EVALSHA", sent)
+		}
+
+		// EVALSHA sha numkeys key id ...
+		if id := sent[len(sent)-1][4]; id != tt.want {
+			t.Errorf("SetIfNewer(%d) sent id %v, want %s", tt.id, id, tt.want)
+		}
+	}
+}
@@ -2,10 +2,14 @@ package registry
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/url"
 	"path"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	docker "github.com/fsouza/go-dockerclient"
@@ -17,13 +21,22 @@ import (
 All config opbects in redis will be stored in a hash with an id key.
 Services will have id, version and environment keys; while Hosts will have id
 and location keys.
-
-TODO: IMPORTANT: make an atomic compare-and-swap script to save configs, or
-      switch to ORDERED SETS and log changes
 */
 
+// ErrSuperseded is returned by RegisterService, along with the stored
+// registration, when a registration from a newer container already exists.
+var ErrSuperseded = errors.New("superseded by a newer registration")
+
+// ErrNoPorts is returned by RegisterService for a container that publishes
+// no ports when SkipPortless is set.
+var ErrNoPorts = errors.New("container exposes no ports")
+
 const (
 	DefaultTTL = 60
+
+	// DefaultReapInterval is how often Reap looks for registrations of
+	// containers that are no longer running.
+	DefaultReapInterval = 60 * time.Second
 )
 
 type ServiceRegistry struct {
@@ -33,6 +46,34 @@ type ServiceRegistry struct {
 	OutputBuffer *utils.OutputBuffer
 	pollCh       chan bool
 	registryURL  string
+
+	// ReapInterval overrides DefaultReapInterval for Reap.
+	ReapInterval time.Duration
+
+	// LabelVars lists the container env vars copied into each
+	// registration's Labels.  Nothing is copied by default so secrets in
+	// the environment aren't published.
+	LabelVars []string
+
+	// ReplicaURLs are read replicas of the registry used by Connect for
+	// read only operations.
+	ReplicaURLs []string
+
+	// SkipPortless skips registering containers that publish no ports.
+	// Otherwise they're registered without addresses, as internal only
+	// services.
+	SkipPortless bool
+
+	// InstrumentRedis has Connect record per command redis timings,
+	// returned by BackendStats.
+	InstrumentRedis bool
+
+	// Audit, if set, is called with the path of each registration that's
+	// written or removed.
+	Audit func(env, action, target string)
+
+	reapMu  sync.Mutex
+	reaping bool
 }
 
 func NewServiceRegistry(ttl uint64) *ServiceRegistry {
@@ -53,25 +94,118 @@ func (r *ServiceRegistry) Connect(registryURL string) {
 	}
 
 	if strings.ToLower(u.Scheme) == "redis" {
-		r.backend = &RedisBackend{
-			RedisHost: u.Host,
+		backend := &RedisBackend{
+			RedisHost:    u.Host,
+			Instrumented: r.InstrumentRedis,
+		}
+		for _, replicaURL := range r.ReplicaURLs {
+			ru, err := url.Parse(replicaURL)
+			if err != nil {
+				log.Fatalf("ERROR: Unable to parse %s", err)
+			}
+			backend.ReplicaHosts = append(backend.ReplicaHosts, ru.Host)
 		}
+		r.backend = backend
 		r.backend.Connect()
 	} else {
 		log.Fatalf("ERROR: Unsupported registry backend: %s", u)
 	}
 }
 
+// Ping checks that the registry is reachable and returns the round trip time.
+func (r *ServiceRegistry) Ping() (time.Duration, error) {
+	start := time.Now()
+	err := r.backend.Ping()
+	return time.Since(start), err
+}
+
+// BackendStats returns the redis command counters of this process when
+// InstrumentRedis is set, or nil.
+func (r *ServiceRegistry) BackendStats() map[string]OpStats {
+	backend, ok := r.backend.(*RedisBackend)
+	if !ok || !backend.Instrumented {
+		return nil
+	}
+	return backend.Stats()
+}
+
+// statsKey holds the redis command counters published by each host.
+const statsKey = "galaxy/stats"
+
+// HostStats are the redis command counters published by an agent.
+type HostStats struct {
+	Host    string             `json:"host"`
+	Updated time.Time          `json:"updated"`
+	Ops     map[string]OpStats `json:"ops"`
+}
+
+// PublishStats writes BackendStats to the registry for hostIP, so other
+// processes can read them with ListHostStats.  It does nothing unless
+// InstrumentRedis is set.
+func (r *ServiceRegistry) PublishStats(hostIP string) error {
+	ops := r.BackendStats()
+	if ops == nil {
+		return nil
+	}
+
+	b, err := json.Marshal(&HostStats{
+		Host:    hostIP,
+		Updated: time.Now().UTC(),
+		Ops:     ops,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = r.backend.Set(statsKey, hostIP, string(b))
+	return err
+}
+
+// ListHostStats returns the stats last published by each host, sorted by
+// host.  Hosts that stopped publishing are still listed; check Updated.
+func (r *ServiceRegistry) ListHostStats() ([]*HostStats, error) {
+	values, err := r.listBackend().GetAll(statsKey)
+	if err != nil {
+		return nil, err
+	}
+
+	hosts := []string{}
+	for host := range values {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+
+	stats := []*HostStats{}
+	for _, host := range hosts {
+		hs := &HostStats{}
+		if err := json.Unmarshal([]byte(values[host]), hs); err != nil {
+			log.Warnf("WARN: Unable to unmarshal stats for %s: %s", host, err)
+			continue
+		}
+		stats = append(stats, hs)
+	}
+	return stats, nil
+}
+
 func (r *ServiceRegistry) newServiceRegistration(container *docker.Container, hostIP string) *ServiceRegistration {
-	//FIXME: We're using the first found port and assuming it's tcp.
-	//How should we handle a service that exposes multiple ports
-	//as well as tcp vs udp ports.
+	// Only one port is registered.  When several are published, use the
+	// lowest numbered tcp port so the choice doesn't change between runs.
 	var externalPort, internalPort string
+	lowest := 0
 	for k, v := range container.NetworkSettings.Ports {
-		if len(v) > 0 {
+		if len(v) == 0 || v[0].HostPort == "" || k.Proto() != "tcp" {
+			continue
+		}
+
+		port, err := strconv.Atoi(k.Port())
+		if err != nil {
+			continue
+		}
+
+		if internalPort == "" || port < lowest {
 			externalPort = v[0].HostPort
 			internalPort = k.Port()
-			break
+			lowest = port
 		}
 	}
 
@@ -107,15 +241,37 @@ type ServiceRegistration struct {
 	VirtualHosts  []string          `json:"VIRTUAL_HOSTS"`
 	Port          string            `json:"PORT"`
 	ErrorPages    map[string]string `json:"ERROR_PAGES,omitempty"`
+	Labels        map[string]string `json:"LABELS,omitempty"`
 }
 
+// Equals reports whether other registers the same container and image at
+// the same addresses.
 func (s *ServiceRegistration) Equals(other ServiceRegistration) bool {
+	return s.SameAddr(other) &&
+		s.ContainerID == other.ContainerID &&
+		s.Image == other.Image &&
+		s.ImageId == other.ImageId
+}
+
+// SameAddr reports whether other is reachable at the same addresses,
+// regardless of which container is behind them.
+func (s *ServiceRegistration) SameAddr(other ServiceRegistration) bool {
 	return s.ExternalIP == other.ExternalIP &&
 		s.ExternalPort == other.ExternalPort &&
 		s.InternalIP == other.InternalIP &&
 		s.InternalPort == other.InternalPort
 }
 
+// LabelString returns Labels as a sorted, comma separated list of k=v pairs.
+func (s *ServiceRegistration) LabelString() string {
+	labels := []string{}
+	for k, v := range s.Labels {
+		labels = append(labels, k+"="+v)
+	}
+	sort.Strings(labels)
+	return strings.Join(labels, ",")
+}
+
 func (s *ServiceRegistration) addr(ip, port string) string {
 	if ip != "" && port != "" {
 		return fmt.Sprint(ip, ":", port)
@@ -142,6 +298,9 @@ func (r *ServiceRegistry) RegisterService(env, pool, hostIP string, container *d
 	registrationPath := path.Join(env, pool, "hosts", hostIP, name, container.ID[0:12])
 
 	serviceRegistration := r.newServiceRegistration(container, hostIP)
+	if r.SkipPortless && serviceRegistration.ExternalPort == "" {
+		return nil, ErrNoPorts
+	}
 	serviceRegistration.Name = name
 	serviceRegistration.ImageId = container.Config.Image
 
@@ -170,20 +329,56 @@ func (r *ServiceRegistry) RegisterService(env, pool, hostIP string, container *d
 
 	serviceRegistration.Port = environment["GALAXY_PORT"]
 
+	for _, k := range r.LabelVars {
+		v, ok := environment[k]
+		if !ok {
+			continue
+		}
+
+		if serviceRegistration.Labels == nil {
+			serviceRegistration.Labels = make(map[string]string)
+		}
+		serviceRegistration.Labels[k] = v
+	}
+
 	jsonReg, err := json.Marshal(serviceRegistration)
 	if err != nil {
 		return nil, err
 	}
 
-	// TODO: use a compare-and-swap SCRIPT
-	_, err = r.backend.Set(registrationPath, "location", string(jsonReg))
+	existingRegistration, err := r.getRegistration(registrationPath)
 	if err != nil {
 		return nil, err
 	}
 
-	_, err = r.backend.Expire(registrationPath, r.TTL)
-	if err != nil {
-		return nil, err
+	// don't overwrite a registration from a newer container
+	if existingRegistration != nil && existingRegistration.StartedAt.After(serviceRegistration.StartedAt) {
+		return existingRegistration, ErrSuperseded
+	}
+
+	if existingRegistration != nil && existingRegistration.Equals(*serviceRegistration) {
+		// nothing changed, so only the TTL needs to be refreshed
+		_, err = r.backend.Expire(registrationPath, r.TTL)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		// the check above is only a shortcut, another host may have written
+		// since.  SetIfNewer makes the final decision atomically.
+		written, err := r.backend.SetIfNewer(registrationPath, serviceRegistration.StartedAt.UnixNano(),
+			"location", string(jsonReg), r.TTL)
+		if err != nil {
+			return nil, err
+		}
+
+		if !written {
+			existingRegistration, err = r.getRegistration(registrationPath)
+			if err != nil {
+				return nil, err
+			}
+			return existingRegistration, ErrSuperseded
+		}
+		r.audit(env, "register", registrationPath)
 	}
 	serviceRegistration.Expires = time.Now().UTC().Add(time.Duration(r.TTL) * time.Second)
 
@@ -214,10 +409,17 @@ func (r *ServiceRegistry) UnRegisterService(env, pool, hostIP string, container
 	if err != nil {
 		return registration, err
 	}
+	r.audit(env, "unregister", registrationPath)
 
 	return registration, nil
 }
 
+func (r *ServiceRegistry) audit(env, action, target string) {
+	if r.Audit != nil {
+		r.Audit(env, action, target)
+	}
+}
+
 func (r *ServiceRegistry) GetServiceRegistration(env, pool, hostIP string, container *docker.Container) (*ServiceRegistration, error) {
 
 	environment := r.EnvFor(container)
@@ -227,8 +429,12 @@ func (r *ServiceRegistry) GetServiceRegistration(env, pool, hostIP string, conta
 		return nil, fmt.Errorf("GALAXY_APP not set on container %s", container.ID[0:12])
 	}
 
-	regPath := path.Join(env, pool, "hosts", hostIP, name, container.ID[0:12])
+	return r.getRegistration(path.Join(env, pool, "hosts", hostIP, name, container.ID[0:12]))
+}
 
+// getRegistration returns the registration stored at regPath, or nil if
+// there is none.
+func (r *ServiceRegistry) getRegistration(regPath string) (*ServiceRegistration, error) {
 	existingRegistration := ServiceRegistration{
 		Path: regPath,
 	}
@@ -256,17 +462,291 @@ func (r *ServiceRegistry) GetServiceRegistration(env, pool, hostIP string, conta
 	return nil, nil
 }
 
+// replicated is implemented by backends with read replicas.
+type replicated interface {
+	Replicas() RegistryBackend
+}
+
+// listBackend returns the backend for listing and status reads, which may be
+// served by a replica and be slightly stale.  Reads that decide a write use
+// r.backend.
+func (r *ServiceRegistry) listBackend() RegistryBackend {
+	if b, ok := r.backend.(replicated); ok {
+		return b.Replicas()
+	}
+	return r.backend
+}
+
+// ListHostRegistrations returns every registration on hostIP keyed by app
+// name.  It fetches them in a single pipelined round trip rather than one
+// lookup per container.
+func (r *ServiceRegistry) ListHostRegistrations(env, pool, hostIP string) (map[string][]*ServiceRegistration, error) {
+	return r.listHostRegistrations(r.listBackend(), env, pool, hostIP)
+}
+
+func (r *ServiceRegistry) listHostRegistrations(backend RegistryBackend, env, pool, hostIP string) (map[string][]*ServiceRegistration, error) {
+	keys, err := backend.Scan(path.Join(env, pool, "hosts", hostIP, "*", "*"))
+	if err != nil {
+		return nil, err
+	}
+
+	regs, err := getRegistrations(backend, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	registrations := make(map[string][]*ServiceRegistration)
+	for _, reg := range regs {
+		registrations[reg.Name] = append(registrations[reg.Name], reg)
+	}
+	return registrations, nil
+}
+
+// ListAppRegistrations returns the registrations of app on every host in env
+// and pool, fetched in a single pipelined round trip.
+func (r *ServiceRegistry) ListAppRegistrations(env, pool, app string) ([]*ServiceRegistration, error) {
+	backend := r.listBackend()
+	keys, err := backend.Scan(path.Join(env, pool, "hosts", "*", app, "*"))
+	if err != nil {
+		return nil, err
+	}
+
+	appKeys := []string{}
+	for _, key := range keys {
+		parts := strings.Split(key, "/")
+		if len(parts) == 6 && parts[4] == app {
+			appKeys = append(appKeys, key)
+		}
+	}
+	return getRegistrations(backend, appKeys)
+}
+
+// getRegistrations reads the registrations at keys with one MultiGet,
+// skipping any that expired since they were listed.
+func getRegistrations(backend RegistryBackend, keys []string) ([]*ServiceRegistration, error) {
+	locations, ttls, err := backend.MultiGet(keys, "location")
+	if err != nil {
+		return nil, err
+	}
+
+	registrations := []*ServiceRegistration{}
+	for i, key := range keys {
+		// expired between SCAN and HGET
+		if locations[i] == "" {
+			continue
+		}
+
+		reg := &ServiceRegistration{
+			Path: key,
+		}
+
+		err := json.Unmarshal([]byte(locations[i]), reg)
+		if err != nil {
+			log.Warnf("WARN: Unable to unmarshal JSON for %s: %s", key, err)
+			continue
+		}
+		reg.Expires = time.Now().UTC().Add(time.Duration(ttls[i]) * time.Second)
+
+		registrations = append(registrations, reg)
+	}
+	return registrations, nil
+}
+
+// AppInstances returns the number of live registrations of app in env and
+// pool, keyed by host IP.
+func (r *ServiceRegistry) AppInstances(env, pool, app string) (map[string]int, error) {
+	backend := r.listBackend()
+	keys, err := backend.Scan(path.Join(env, pool, "hosts", "*", app, "*"))
+	if err != nil {
+		return nil, err
+	}
+
+	locations, _, err := backend.MultiGet(keys, "location")
+	if err != nil {
+		return nil, err
+	}
+
+	instances := make(map[string]int)
+	for i, key := range keys {
+		// expired between SCAN and HGET
+		if locations[i] == "" {
+			continue
+		}
+
+		parts := strings.Split(key, "/")
+		if len(parts) != 6 {
+			continue
+		}
+		instances[parts[3]]++
+	}
+	return instances, nil
+}
+
+// CountInstances returns the number of live registrations of app in env and
+// pool across all hosts.
+func (r *ServiceRegistry) CountInstances(env, pool, app string) (int, error) {
+	instances, err := r.AppInstances(env, pool, app)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, n := range instances {
+		count += n
+	}
+	return count, nil
+}
+
+// ReapHost unregisters every registration on hostIP whose container is not
+// in the list returned by running, and returns the registrations removed.
+// running is called after the registrations are read so that a container
+// started in between is never reaped.
+func (r *ServiceRegistry) ReapHost(env, pool, hostIP string, running func() ([]string, error)) ([]*ServiceRegistration, error) {
+	registrations, err := r.listHostRegistrations(r.backend, env, pool, hostIP)
+	if err != nil {
+		return nil, err
+	}
+
+	containerIDs, err := running()
+	if err != nil {
+		return nil, err
+	}
+
+	reaped := []*ServiceRegistration{}
+	for _, regs := range registrations {
+		for _, reg := range regs {
+			if utils.StringInSlice(reg.ContainerID, containerIDs) {
+				continue
+			}
+
+			_, err := r.backend.Delete(reg.Path)
+			if err != nil {
+				return reaped, err
+			}
+			r.audit(env, "reap", reg.Path)
+			reaped = append(reaped, reg)
+		}
+	}
+	return reaped, nil
+}
+
+// DeleteAppRegistrations removes the registrations of apps on every host in
+// env and pool, with one scan and one delete, and returns how many were
+// removed.
+func (r *ServiceRegistry) DeleteAppRegistrations(env, pool string, apps ...string) (int, error) {
+	if len(apps) == 0 {
+		return 0, nil
+	}
+
+	keys, err := r.backend.Scan(path.Join(env, pool, "hosts", "*"))
+	if err != nil {
+		return 0, err
+	}
+
+	registrations := []string{}
+	for _, key := range keys {
+		parts := strings.Split(key, "/")
+		if len(parts) != 6 || !utils.StringInSlice(parts[4], apps) {
+			continue
+		}
+		registrations = append(registrations, key)
+	}
+
+	deleted, err := r.backend.Delete(registrations...)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, key := range registrations {
+		r.audit(env, "unregister", key)
+	}
+	return deleted, nil
+}
+
+// Reap calls ReapHost every ReapInterval until stop is closed, logging the
+// registrations it removes.  Only one Reap runs at a time; calling it again
+// while one is running returns immediately.
+func (r *ServiceRegistry) Reap(env, pool, hostIP string, running func() ([]string, error), stop chan struct{}) {
+	r.reapMu.Lock()
+	if r.reaping {
+		r.reapMu.Unlock()
+		return
+	}
+	r.reaping = true
+	r.reapMu.Unlock()
+
+	defer func() {
+		r.reapMu.Lock()
+		r.reaping = false
+		r.reapMu.Unlock()
+	}()
+
+	interval := r.ReapInterval
+	if interval <= 0 {
+		interval = DefaultReapInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			reaped, err := r.ReapHost(env, pool, hostIP, running)
+			if err != nil {
+				log.Errorf("ERROR: Unable to reap registrations: %s", err)
+			}
+
+			for _, reg := range reaped {
+				log.Printf("Reaped stale registration of %s for %s", path.Base(reg.Path), reg.Name)
+			}
+		}
+	}
+}
+
 func (r *ServiceRegistry) IsRegistered(env, pool, hostIP string, container *docker.Container) (bool, error) {
 
 	reg, err := r.GetServiceRegistration(env, pool, hostIP, container)
 	return reg != nil, err
 }
 
+// ListEnvironments returns every env with at least one registration.
+func (r *ServiceRegistry) ListEnvironments() ([]string, error) {
+	return r.listKeyParts(path.Join("*", "*", "hosts", "*", "*", "*"), 0)
+}
+
+// ListPools returns every pool in env with at least one registration.
+func (r *ServiceRegistry) ListPools(env string) ([]string, error) {
+	return r.listKeyParts(path.Join(env, "*", "hosts", "*", "*", "*"), 1)
+}
+
+// listKeyParts returns the unique values of path element i of the keys
+// matching pattern.
+func (r *ServiceRegistry) listKeyParts(pattern string, i int) ([]string, error) {
+	keys, err := r.listBackend().Scan(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	values := []string{}
+	for _, key := range keys {
+		parts := strings.Split(key, "/")
+		if len(parts) <= i {
+			continue
+		}
+		if !utils.StringInSlice(parts[i], values) {
+			values = append(values, parts[i])
+		}
+	}
+	return values, nil
+}
+
 // TODO: get all ServiceRegistrations
 func (r *ServiceRegistry) ListRegistrations(env string) ([]ServiceRegistration, error) {
+	backend := r.listBackend()
 
-	// TODO: convert to scan
-	keys, err := r.backend.Keys(path.Join(env, "*", "hosts", "*", "*", "*"))
+	keys, err := backend.Scan(path.Join(env, "*", "hosts", "*", "*", "*"))
 	if err != nil {
 		return nil, err
 	}
@@ -274,9 +754,13 @@ func (r *ServiceRegistry) ListRegistrations(env string) ([]ServiceRegistration,
 	var regList []ServiceRegistration
 	for _, key := range keys {
 
-		val, err := r.backend.Get(key, "location")
+		val, err := backend.Get(key, "location")
 		if err != nil {
-			log.Warnf("WARN: Unable to get location for %s: %s", key, err)
+			return nil, err
+		}
+
+		// expired since the scan
+		if val == "" {
 			continue
 		}
 
@@ -301,6 +785,9 @@ func (s *ServiceRegistry) EnvFor(container *docker.Container) map[string]string
 	env := map[string]string{}
 	for _, item := range container.Config.Env {
 		sep := strings.Index(item, "=")
+		if sep < 0 {
+			continue
+		}
 		k := item[0:sep]
 		v := item[sep+1:]
 		env[k] = v
@@ -0,0 +1,514 @@
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+func NewTestRegistry() (*ServiceRegistry, *MemoryBackend) {
+	r := NewServiceRegistry(DefaultTTL)
+	b := NewMemoryBackend()
+	r.backend = b
+	return r, b
+}
+
+func newTestContainer(id, app string, created time.Time) *docker.Container {
+	return &docker.Container{
+		ID:      id,
+		Name:    "/" + app,
+		Created: created,
+		Config: &docker.Config{
+			Image: app + ":latest",
+			Env:   []string{"GALAXY_APP=" + app},
+		},
+		NetworkSettings: &docker.NetworkSettings{
+			IPAddress: "172.17.0.2",
+			Ports: map[docker.Port][]docker.PortBinding{
+				docker.Port("8080"): {{HostIp: "0.0.0.0", HostPort: "49153"}},
+			},
+		},
+	}
+}
+
+const (
+	testContainerID = "0123456789abcdef0123456789abcdef"
+	testRegPath     = "dev/web/hosts/10.0.0.1/app/0123456789ab"
+)
+
+func TestRegisterServiceNew(t *testing.T) {
+	r, b := NewTestRegistry()
+
+	c := newTestContainer(testContainerID, "app", time.Now())
+	reg, err := r.RegisterService("dev", "web", "10.0.0.1", c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if reg.ExternalAddr() != "10.0.0.1:49153" {
+		t.Errorf("ExternalAddr() = %q, want %q", reg.ExternalAddr(), "10.0.0.1:49153")
+	}
+
+	existing, err := r.GetServiceRegistration("dev", "web", "10.0.0.1", c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if existing == nil || existing.ContainerID != testContainerID {
+		t.Fatalf("GetServiceRegistration() = %v, want %s", existing, testContainerID)
+	}
+
+	if ttl, _ := b.Ttl(testRegPath); ttl != DefaultTTL {
+		t.Errorf("Ttl(%q) = %d, want %d", testRegPath, ttl, DefaultTTL)
+	}
+}
+
+func TestRegisterServiceNewerExisting(t *testing.T) {
+	r, _ := NewTestRegistry()
+
+	now := time.Now()
+	newer := newTestContainer(testContainerID, "app", now)
+	if _, err := r.RegisterService("dev", "web", "10.0.0.1", newer); err != nil {
+		t.Fatal(err)
+	}
+
+	older := newTestContainer(testContainerID, "app", now.Add(-time.Minute))
+	older.NetworkSettings.IPAddress = "172.17.0.9"
+	reg, err := r.RegisterService("dev", "web", "10.0.0.1", older)
+	if err != ErrSuperseded {
+		t.Fatalf("RegisterService() error = %v, want %v", err, ErrSuperseded)
+	}
+
+	if reg.InternalIP != "172.17.0.2" {
+		t.Errorf("RegisterService() overwrote a newer registration: InternalIP = %q, want %q",
+			reg.InternalIP, "172.17.0.2")
+	}
+}
+
+func TestRegisterServiceIdenticalExisting(t *testing.T) {
+	r, b := NewTestRegistry()
+
+	c := newTestContainer(testContainerID, "app", time.Now())
+	if _, err := r.RegisterService("dev", "web", "10.0.0.1", c); err != nil {
+		t.Fatal(err)
+	}
+
+	// mark the stored registration so a rewrite can be detected
+	stored := ServiceRegistration{}
+	json.Unmarshal([]byte(b.maps[testRegPath]["location"]), &stored)
+	stored.ContainerName = "marker"
+	marked, _ := json.Marshal(stored)
+	b.maps[testRegPath]["location"] = string(marked)
+	b.ttls[testRegPath] = 1
+
+	if _, err := r.RegisterService("dev", "web", "10.0.0.1", c); err != nil {
+		t.Fatal(err)
+	}
+
+	existing, _ := r.GetServiceRegistration("dev", "web", "10.0.0.1", c)
+	if existing.ContainerName != "marker" {
+		t.Errorf("RegisterService() rewrote an identical registration")
+	}
+
+	if ttl, _ := b.Ttl(testRegPath); ttl != DefaultTTL {
+		t.Errorf("Ttl(%q) = %d, want %d", testRegPath, ttl, DefaultTTL)
+	}
+}
+
+func TestUnRegisterService(t *testing.T) {
+	r, b := NewTestRegistry()
+
+	c := newTestContainer(testContainerID, "app", time.Now())
+	if _, err := r.RegisterService("dev", "web", "10.0.0.1", c); err != nil {
+		t.Fatal(err)
+	}
+
+	reg, err := r.UnRegisterService("dev", "web", "10.0.0.1", c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if reg == nil {
+		t.Fatal("UnRegisterService() = nil, want the removed registration")
+	}
+
+	if _, ok := b.maps[testRegPath]; ok {
+		t.Errorf("%s still exists after UnRegisterService()", testRegPath)
+	}
+}
+
+func TestReapHost(t *testing.T) {
+	r, b := NewTestRegistry()
+
+	running := newTestContainer(testContainerID, "app", time.Now())
+	stopped := newTestContainer("fedcba9876543210fedcba9876543210", "app", time.Now())
+	for _, c := range []*docker.Container{running, stopped} {
+		if _, err := r.RegisterService("dev", "web", "10.0.0.1", c); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reaped, err := r.ReapHost("dev", "web", "10.0.0.1", func() ([]string, error) {
+		return []string{running.ID}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(reaped) != 1 || reaped[0].ContainerID != stopped.ID {
+		t.Fatalf("ReapHost() = %v, want only %s", reaped, stopped.ID)
+	}
+
+	if _, ok := b.maps[testRegPath]; !ok {
+		t.Errorf("ReapHost() removed the registration of a running container")
+	}
+}
+
+func TestReap(t *testing.T) {
+	r, b := NewTestRegistry()
+	r.ReapInterval = 10 * time.Millisecond
+
+	c := newTestContainer(testContainerID, "app", time.Now())
+	if _, err := r.RegisterService("dev", "web", "10.0.0.1", c); err != nil {
+		t.Fatal(err)
+	}
+
+	checked := make(chan bool, 10)
+	running := func() ([]string, error) {
+		checked <- true
+		return nil, nil
+	}
+
+	stop := make(chan struct{})
+	done := make(chan bool)
+	go func() {
+		r.Reap("dev", "web", "10.0.0.1", running, stop)
+		close(done)
+	}()
+
+	select {
+	case <-checked:
+	case <-time.After(time.Second):
+		t.Fatal("Reap() never checked the running containers")
+	}
+
+	// a second reaper on the same registry returns at once
+	second := make(chan bool)
+	go func() {
+		r.Reap("dev", "web", "10.0.0.1", running, nil)
+		close(second)
+	}()
+
+	select {
+	case <-second:
+	case <-time.After(time.Second):
+		t.Fatal("a second Reap() kept running")
+	}
+
+	close(stop)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Reap() didn't return after stop was closed")
+	}
+
+	b.Lock()
+	_, ok := b.maps[testRegPath]
+	b.Unlock()
+	if ok {
+		t.Errorf("Reap() left the registration of a stopped container")
+	}
+}
+
+func TestRegisterServiceConcurrent(t *testing.T) {
+	r, b := NewTestRegistry()
+
+	now := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c := newTestContainer(testContainerID, "app", now.Add(time.Duration(i)*time.Second))
+			c.NetworkSettings.IPAddress = fmt.Sprintf("172.17.0.%d", i)
+			_, err := r.RegisterService("dev", "web", "10.0.0.1", c)
+			if err != nil && err != ErrSuperseded {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	stored := ServiceRegistration{}
+	json.Unmarshal([]byte(b.maps[testRegPath]["location"]), &stored)
+	if stored.InternalIP != "172.17.0.19" {
+		t.Errorf("InternalIP = %q, want the newest container's %q", stored.InternalIP, "172.17.0.19")
+	}
+}
+
+func TestRegistrationEquals(t *testing.T) {
+	r, _ := NewTestRegistry()
+
+	c := newTestContainer(testContainerID, "app", time.Now())
+	reg := r.newServiceRegistration(c, "10.0.0.1")
+
+	redeployed := newTestContainer("fedcba9876543210fedcba9876543210", "app", time.Now())
+	other := r.newServiceRegistration(redeployed, "10.0.0.1")
+
+	if !reg.SameAddr(*other) {
+		t.Errorf("SameAddr() = false for the same address")
+	}
+
+	if reg.Equals(*other) {
+		t.Errorf("Equals() = true for the same address with a new container id")
+	}
+
+	other = r.newServiceRegistration(c, "10.0.0.1")
+	other.Image = "app:v2"
+	if reg.Equals(*other) {
+		t.Errorf("Equals() = true for the same container with a new image")
+	}
+
+	if !reg.Equals(*r.newServiceRegistration(c, "10.0.0.1")) {
+		t.Errorf("Equals() = false for identical registrations")
+	}
+}
+
+func TestAppInstances(t *testing.T) {
+	r, _ := NewTestRegistry()
+
+	instances, err := r.AppInstances("dev", "web", "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if instances == nil || len(instances) != 0 {
+		t.Fatalf("AppInstances() = %v, want an empty map", instances)
+	}
+
+	ids := []string{testContainerID, "fedcba9876543210fedcba9876543210", "00112233445566778899aabbccddeeff"}
+	hosts := []string{"10.0.0.1", "10.0.0.1", "10.0.0.2"}
+	for i, id := range ids {
+		if _, err := r.RegisterService("dev", "web", hosts[i], newTestContainer(id, "app", time.Now())); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r.RegisterService("dev", "web", "10.0.0.2", newTestContainer("ffeeddccbbaa99887766554433221100", "other", time.Now()))
+
+	instances, err = r.AppInstances("dev", "web", "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if instances["10.0.0.1"] != 2 || instances["10.0.0.2"] != 1 || len(instances) != 2 {
+		t.Errorf("AppInstances() = %v, want map[10.0.0.1:2 10.0.0.2:1]", instances)
+	}
+
+	if count, _ := r.CountInstances("dev", "web", "app"); count != 3 {
+		t.Errorf("CountInstances() = %d, want %d", count, 3)
+	}
+}
+
+func TestListAppRegistrations(t *testing.T) {
+	r, _ := NewTestRegistry()
+
+	r.RegisterService("dev", "web", "10.0.0.1", newTestContainer(testContainerID, "app", time.Now()))
+	r.RegisterService("dev", "web", "10.0.0.2", newTestContainer("fedcba9876543210fedcba9876543210", "app", time.Now()))
+	r.RegisterService("dev", "web", "10.0.0.2", newTestContainer("00112233445566778899aabbccddeeff", "other", time.Now()))
+	r.RegisterService("dev", "worker", "10.0.0.3", newTestContainer("ffeeddccbbaa99887766554433221100", "app", time.Now()))
+
+	registrations, err := r.ListAppRegistrations("dev", "web", "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(registrations) != 2 {
+		t.Fatalf("ListAppRegistrations() = %d registrations, want %d", len(registrations), 2)
+	}
+
+	for _, reg := range registrations {
+		if reg.Name != "app" || !strings.HasPrefix(reg.Path, "dev/web/hosts/") {
+			t.Errorf("ListAppRegistrations() returned %s, want only app in dev/web", reg.Path)
+		}
+	}
+}
+
+func TestRegisterServiceLabels(t *testing.T) {
+	r, _ := NewTestRegistry()
+	r.LabelVars = []string{"GIT_SHA", "APP_VERSION"}
+
+	c := newTestContainer(testContainerID, "app", time.Now())
+	c.Config.Env = append(c.Config.Env, "GIT_SHA=abc123", "PASSWORD=secret", "MALFORMED")
+
+	if _, err := r.RegisterService("dev", "web", "10.0.0.1", c); err != nil {
+		t.Fatal(err)
+	}
+
+	reg, err := r.GetServiceRegistration("dev", "web", "10.0.0.1", c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(reg.Labels) != 1 || reg.Labels["GIT_SHA"] != "abc123" {
+		t.Errorf("Labels = %v, want map[GIT_SHA:abc123]", reg.Labels)
+	}
+
+	if reg.LabelString() != "GIT_SHA=abc123" {
+		t.Errorf("LabelString() = %q, want %q", reg.LabelString(), "GIT_SHA=abc123")
+	}
+}
+
+func TestRegisterServiceNoPorts(t *testing.T) {
+	r, b := NewTestRegistry()
+
+	c := newTestContainer(testContainerID, "app", time.Now())
+	c.NetworkSettings.Ports = nil
+
+	reg, err := r.RegisterService("dev", "web", "10.0.0.1", c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if reg.ExternalAddr() != "" || reg.InternalAddr() != "" {
+		t.Errorf("addrs = %q, %q, want none for a container without ports",
+			reg.ExternalAddr(), reg.InternalAddr())
+	}
+
+	r, b = NewTestRegistry()
+	r.SkipPortless = true
+	if _, err := r.RegisterService("dev", "web", "10.0.0.1", c); err != ErrNoPorts {
+		t.Fatalf("RegisterService() error = %v, want %v", err, ErrNoPorts)
+	}
+
+	if _, ok := b.maps[testRegPath]; ok {
+		t.Errorf("registered a container without ports with SkipPortless set")
+	}
+}
+
+func TestRegisterServiceMultiplePorts(t *testing.T) {
+	r, _ := NewTestRegistry()
+
+	c := newTestContainer(testContainerID, "app", time.Now())
+	c.NetworkSettings.Ports = map[docker.Port][]docker.PortBinding{
+		docker.Port("9000/tcp"): {{HostIp: "0.0.0.0", HostPort: "49155"}},
+		docker.Port("53/udp"):   {{HostIp: "0.0.0.0", HostPort: "49156"}},
+		docker.Port("443/tcp"):  {{HostIp: "0.0.0.0", HostPort: "49154"}},
+		docker.Port("80/tcp"):   {},
+	}
+
+	for i := 0; i < 10; i++ {
+		reg := r.newServiceRegistration(c, "10.0.0.1")
+		if reg.ExternalAddr() != "10.0.0.1:49154" || reg.InternalAddr() != "172.17.0.2:443" {
+			t.Fatalf("addrs = %q, %q, want the lowest published tcp port",
+				reg.ExternalAddr(), reg.InternalAddr())
+		}
+	}
+}
+
+func TestDeleteAppRegistrations(t *testing.T) {
+	r, b := NewTestRegistry()
+
+	r.RegisterService("dev", "web", "10.0.0.1", newTestContainer(testContainerID, "app", time.Now()))
+	r.RegisterService("dev", "web", "10.0.0.2", newTestContainer("fedcba9876543210fedcba9876543210", "app", time.Now()))
+	r.RegisterService("dev", "web", "10.0.0.1", newTestContainer("00112233445566778899aabbccddeeff", "other", time.Now()))
+	r.RegisterService("dev", "worker", "10.0.0.3", newTestContainer("ffeeddccbbaa99887766554433221100", "app", time.Now()))
+
+	deleted, err := r.DeleteAppRegistrations("dev", "web", "app")
+	if deleted != 2 || err != nil {
+		t.Fatalf("DeleteAppRegistrations() = %d, %v, want %d, %v", deleted, err, 2, nil)
+	}
+
+	if len(b.maps) != 2 {
+		t.Errorf("%d registrations left, want the other app's and the other pool's", len(b.maps))
+	}
+
+	deleted, err = r.DeleteAppRegistrations("dev", "web", "app", "other")
+	if deleted != 1 || err != nil {
+		t.Fatalf("DeleteAppRegistrations() = %d, %v, want %d, %v", deleted, err, 1, nil)
+	}
+
+	if deleted, err := r.DeleteAppRegistrations("dev", "worker"); deleted != 0 || err != nil {
+		t.Errorf("DeleteAppRegistrations() with no apps = %d, %v, want %d, %v", deleted, err, 0, nil)
+	}
+}
+
+func TestRegisterServiceAudit(t *testing.T) {
+	r, _ := NewTestRegistry()
+
+	actions := []string{}
+	r.Audit = func(env, action, target string) {
+		actions = append(actions, action+" "+target)
+	}
+
+	c := newTestContainer(testContainerID, "app", time.Now())
+	r.RegisterService("dev", "web", "10.0.0.1", c)
+	r.RegisterService("dev", "web", "10.0.0.1", c)
+	r.UnRegisterService("dev", "web", "10.0.0.1", c)
+
+	want := []string{"register " + testRegPath, "unregister " + testRegPath}
+	if fmt.Sprint(actions) != fmt.Sprint(want) {
+		t.Errorf("audited %v, want %v", actions, want)
+	}
+}
+
+func TestMigrateSchema(t *testing.T) {
+	r, b := NewTestRegistry()
+
+	legacy := "dev/web/hosts/10.0.0.1/app"
+	location, _ := json.Marshal(r.newServiceRegistration(newTestContainer(testContainerID, "app", time.Now()), "10.0.0.1"))
+	b.Set(legacy, "location", string(location))
+	b.Set("dev/web/hosts/10.0.0.1/broken", "location", "{}")
+	// host info is left alone, even when it parses as a registration
+	info := "dev/web/hosts/10.0.0.1/info"
+	b.Set(info, "location", string(location))
+
+	if v, _ := r.StoredSchemaVersion(); v != 1 {
+		t.Fatalf("StoredSchemaVersion() = %d, want %d", v, 1)
+	}
+
+	changes, err := r.MigrateSchema(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(changes) != 2 || changes[0] != "move "+legacy+" to "+testRegPath {
+		t.Fatalf("MigrateSchema(true) = %v, want a move to %s and the version", changes, testRegPath)
+	}
+
+	if _, ok := b.maps[testRegPath]; ok {
+		t.Fatal("MigrateSchema(true) changed the registry")
+	}
+
+	if _, err := r.MigrateSchema(false); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := b.maps[legacy]; ok {
+		t.Errorf("%s still exists after MigrateSchema()", legacy)
+	}
+
+	if b.maps[testRegPath]["location"] != string(location) {
+		t.Errorf("%s = %v, want the migrated registration", testRegPath, b.maps[testRegPath])
+	}
+
+	if ttl, _ := b.Ttl(testRegPath); ttl != DefaultTTL {
+		t.Errorf("Ttl(%q) = %d, want %d", testRegPath, ttl, DefaultTTL)
+	}
+
+	if v, _ := r.StoredSchemaVersion(); v != SchemaVersion {
+		t.Errorf("StoredSchemaVersion() = %d, want %d", v, SchemaVersion)
+	}
+
+	if changes, _ := r.MigrateSchema(false); len(changes) != 0 {
+		t.Errorf("MigrateSchema() again = %v, want no changes", changes)
+	}
+
+	if _, ok := b.maps[info]; !ok {
+		t.Errorf("%s was migrated", info)
+	}
+}
@@ -0,0 +1,132 @@
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/litl/galaxy/log"
+)
+
+// SchemaVersion is the layout of registry keys written by this version.
+//
+//	1: <env>/<pool>/hosts/<host>/<app>
+//	2: <env>/<pool>/hosts/<host>/<app>/<container id>
+const SchemaVersion = 2
+
+// schemaKey holds the schema version of the stored keys.  Registries without
+// it are assumed to be at version 1.
+const schemaKey = "galaxy/schema"
+
+// StoredSchemaVersion returns the schema version recorded in the registry.
+func (r *ServiceRegistry) StoredSchemaVersion() (int, error) {
+	v, err := r.backend.Get(schemaKey, "version")
+	if err != nil {
+		return 0, err
+	}
+
+	if v == "" {
+		return 1, nil
+	}
+	return strconv.Atoi(v)
+}
+
+// MigrateSchema moves keys written by older versions to the current layout
+// and records SchemaVersion.  It returns a description of each change, and
+// with dryRun only reports them.  It's safe to run again after a partial
+// migration, and concurrently with agents writing the new layout.
+func (r *ServiceRegistry) MigrateSchema(dryRun bool) ([]string, error) {
+	version, err := r.StoredSchemaVersion()
+	if err != nil {
+		return nil, err
+	}
+
+	if version > SchemaVersion {
+		return nil, fmt.Errorf("registry schema %d is newer than %d", version, SchemaVersion)
+	}
+
+	changes := []string{}
+	if version < 2 {
+		changes, err = r.migrateRegistrationKeys(dryRun)
+		if err != nil {
+			return changes, err
+		}
+	}
+
+	if version < SchemaVersion {
+		changes = append(changes, fmt.Sprintf("set schema version %d", SchemaVersion))
+		if !dryRun {
+			_, err = r.backend.Set(schemaKey, "version", strconv.Itoa(SchemaVersion))
+			if err != nil {
+				return changes, err
+			}
+		}
+	}
+	return changes, nil
+}
+
+// migrateRegistrationKeys moves registrations keyed by app to keys by
+// container, so several containers of an app can be registered on one host.
+func (r *ServiceRegistry) migrateRegistrationKeys(dryRun bool) ([]string, error) {
+	keys, err := r.backend.Scan("*/*/hosts/*/*")
+	if err != nil {
+		return nil, err
+	}
+
+	changes := []string{}
+	for _, key := range keys {
+		parts := strings.Split(key, "/")
+		if len(parts) != 5 {
+			continue
+		}
+
+		// env/pool/hosts/<ip>/info is the config store's host info, not a
+		// registration
+		if parts[4] == "info" {
+			continue
+		}
+
+		location, err := r.backend.Get(key, "location")
+		if err != nil {
+			return changes, err
+		}
+
+		reg := ServiceRegistration{}
+		err = json.Unmarshal([]byte(location), &reg)
+		if err != nil || len(reg.ContainerID) < 12 {
+			log.Warnf("WARN: Skipping registration %s without a container id", key)
+			continue
+		}
+
+		newKey := key + "/" + reg.ContainerID[0:12]
+		changes = append(changes, fmt.Sprintf("move %s to %s", key, newKey))
+		if dryRun {
+			continue
+		}
+
+		ttl, err := r.backend.Ttl(key)
+		if err != nil {
+			return changes, err
+		}
+
+		if ttl == -1 {
+			ttl = int(r.TTL)
+		}
+
+		if ttl > 0 {
+			// a newer registration already written by an agent wins
+			_, err = r.backend.SetIfNewer(newKey, reg.StartedAt.UnixNano(), "location", location, uint64(ttl))
+			if err != nil {
+				return changes, err
+			}
+		}
+
+		_, err = r.backend.Delete(key)
+		if err != nil {
+			return changes, err
+		}
+		log.Printf("Migrated %s to %s", key, newKey)
+	}
+	return changes, nil
+}
@@ -822,6 +822,10 @@ func (s *ServiceRuntime) RegisterAll(env, pool, hostIP string) ([]*registry.Serv
 	for _, container := range containers {
 		name := s.EnvFor(container)["GALAXY_APP"]
 		registration, err := s.serviceRegistry.RegisterService(env, pool, hostIP, container)
+		if err == registry.ErrSuperseded || err == registry.ErrNoPorts {
+			log.Debugf("Skipped registering %s as %s: %s", container.ID[0:12], name, err)
+			continue
+		}
 		if err != nil {
 			log.Printf("ERROR: Could not register %s: %s\n", name, err)
 			continue
@@ -0,0 +1,35 @@
+package utils
+
+import (
+	"fmt"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// HashValues converts an HGETALL reply into a map.  Fields with a nil value
+// are skipped; any other value that isn't a string is an error rather than a
+// panic.
+func HashValues(key string, reply []interface{}) (map[string]string, error) {
+	if len(reply)%2 != 0 {
+		return nil, fmt.Errorf("malformed HGETALL reply for %s: %d values", key, len(reply))
+	}
+
+	values := make(map[string]string)
+	for i := 0; i < len(reply); i += 2 {
+		if reply[i+1] == nil {
+			continue
+		}
+
+		field, err := redis.String(reply[i], nil)
+		if err != nil {
+			return nil, fmt.Errorf("malformed HGETALL reply for %s: field %d: %s", key, i/2, err)
+		}
+
+		value, err := redis.String(reply[i+1], nil)
+		if err != nil {
+			return nil, fmt.Errorf("malformed HGETALL reply for %s: %s: %s", key, field, err)
+		}
+		values[field] = value
+	}
+	return values, nil
+}
@@ -0,0 +1,24 @@
+package utils
+
+import (
+	"testing"
+)
+
+func TestHashValues(t *testing.T) {
+	values, err := HashValues("key", []interface{}{[]byte("location"), nil, "id", []byte("1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(values) != 1 || values["id"] != "1" {
+		t.Errorf("HashValues() = %v, want map[id:1]", values)
+	}
+
+	if _, err := HashValues("key", []interface{}{[]byte("id"), int64(1)}); err == nil {
+		t.Error("HashValues() should fail on a non-string value")
+	}
+
+	if _, err := HashValues("key", []interface{}{[]byte("id")}); err == nil {
+		t.Error("HashValues() should fail on an odd number of values")
+	}
+}
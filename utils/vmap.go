@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"fmt"
 	"strconv"
 	"strings"
 )
@@ -125,15 +126,26 @@ func (v *VersionedMap) MarshalMap() map[string]string {
 func (v *VersionedMap) UnmarshalMap(serialized map[string]string) error {
 
 	for key, val := range serialized {
+		// fields are key:op:version; the key itself may contain ":"
 		parts := strings.Split(key, ":")
-		version, err := strconv.ParseInt(parts[2], 10, 64)
+		if len(parts) < 3 {
+			return fmt.Errorf("malformed versioned field %q", key)
+		}
+
+		name := strings.Join(parts[:len(parts)-2], ":")
+		op := parts[len(parts)-2]
+		version, err := strconv.ParseInt(parts[len(parts)-1], 10, 64)
 		if err != nil {
-			return err
+			return fmt.Errorf("malformed versioned field %q: %s", key, err)
 		}
-		if parts[1] == "s" {
-			v.SetVersion(parts[0], val, version)
-		} else {
-			v.UnSetVersion(parts[0], version)
+
+		switch op {
+		case "s":
+			v.SetVersion(name, val, version)
+		case "u":
+			v.UnSetVersion(name, version)
+		default:
+			return fmt.Errorf("malformed versioned field %q: unknown op %q", key, op)
 		}
 	}
 	return nil
@@ -206,3 +206,23 @@ func TestMarshalExpiredWithAge(t *testing.T) {
 		t.Fatalf("Expected value not found. Got %#v", old)
 	}
 }
+
+func TestUnmarshalMapColonKey(t *testing.T) {
+	vmap := NewVersionedMap()
+	if err := vmap.UnmarshalMap(map[string]string{"a:b:s:1": "v1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if vmap.Get("a:b") != "v1" {
+		t.Errorf("Get(a:b) = %q, want v1", vmap.Get("a:b"))
+	}
+}
+
+func TestUnmarshalMapMalformed(t *testing.T) {
+	for _, field := range []string{"k1", "k1:s", "k1:s:x", "k1:x:1"} {
+		vmap := NewVersionedMap()
+		if err := vmap.UnmarshalMap(map[string]string{field: "v1"}); err == nil {
+			t.Errorf("UnmarshalMap(%q) should fail", field)
+		}
+	}
+}